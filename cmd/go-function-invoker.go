@@ -21,37 +21,169 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/projectriff/go-function-invoker/pkg/function"
+	"github.com/projectriff/go-function-invoker/pkg/rpc"
 	"github.com/projectriff/go-function-invoker/pkg/server"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 )
 
 func main() {
 
 	port := flag.Int("port", 10382, "The server port")
+	protocol := flag.String("protocol", server.MessageFunctionProtocol, fmt.Sprintf("The protocol spoken with the sidecar, either %q or %q", server.MessageFunctionProtocol, server.RiffRpcProtocol))
+	configEnvPrefix := flag.String("config-env-prefix", "FUNCTION_CONFIG_", "The prefix of environment variables passed as configuration to the function")
+	configDir := flag.String("config-dir", "", "A directory whose files are passed as configuration to the function")
+	batchSize := flag.Int("batch-size", 0, "The maximum number of inputs passed at once to batching functions (0 to disable batching)")
+	batchMaxWait := flag.Duration("batch-max-wait", 100*time.Millisecond, "The maximum time to wait for a batch to fill up (0 to wait indefinitely)")
+	split := flag.Bool("split", false, "Whether to send each element of a slice returned by a function as its own message")
+	inputs := flag.String("inputs", "", "Comma separated names of the input streams of the function")
+	outputs := flag.String("outputs", "", "Comma separated names of the output streams of the function")
+	cloudEvents := flag.Bool("cloudevents", false, "Whether to wrap function outputs as CloudEvents")
+	ceSource := flag.String("ce-source", server.DefaultCloudEventSource, "The source of CloudEvents emitted by the function")
+	ceType := flag.String("ce-type", server.DefaultCloudEventType, "The type of CloudEvents emitted by the function")
+	deadLetterOutput := flag.Int("dead-letter-output", -1, "The output index that messages failing unmarshalling or invocation are emitted to (negative to disable)")
+	deadLetterFile := flag.String("dead-letter-file", "", "A file that messages failing unmarshalling or invocation are appended to, as json lines")
+	maxAttempts := flag.Int("max-attempts", 1, "The maximum number of times a function returning an error is invoked for a given input (1 to disable retries)")
+	retryBackoff := flag.Duration("retry-backoff", server.DefaultRetryBackoff, "The time to wait before retrying a failed invocation, doubled on each attempt")
+	retryMaxBackoff := flag.Duration("retry-max-backoff", server.DefaultRetryMaxBackoff, "The maximum time to wait before retrying a failed invocation")
+	streamRate := flag.Float64("stream-rate", 0, "The maximum number of messages per second on each stream (0 for unlimited)")
+	globalRate := flag.Float64("global-rate", 0, "The maximum number of messages per second across all streams (0 for unlimited)")
+	maxStreams := flag.Int("max-streams", 0, "The maximum number of concurrent streams (0 for unlimited)")
+	maxInFlight := flag.Int("max-in-flight", 0, "The maximum number of concurrent function invocations (0 for unlimited)")
+	rejectOverLimit := flag.Bool("reject-over-limit", false, "Whether to reject callers over the limits with RESOURCE_EXHAUSTED, rather than delay them")
+	maxReceiveSize := flag.Int("max-receive-size", 0, "The maximum size (in bytes) of incoming messages (0 for the gRPC default of 4MB)")
+	maxSendSize := flag.Int("max-send-size", 0, "The maximum size (in bytes) of outgoing messages (0 for unlimited)")
+	maxPayloadSize := flag.Int("max-payload-size", server.DefaultMaxPayloadSize, "The maximum size (in bytes) of incoming payloads once decompressed or reassembled from chunks (0 for unlimited)")
+	chunkSize := flag.Int("chunk-size", 0, "The size (in bytes) from which payloads are split across several messages (0 to disable chunking)")
+	idleTimeout := flag.Duration("idle-timeout", 0, "The time after which the input of a stream ends if no message arrived on it (0 to disable)")
+	inputQueueSize := flag.Int("input-queue-size", server.DefaultInputQueueSize, "The number of messages queued for each input of functions with several inputs, until they read them (0 for unbounded)")
+	leakGracePeriod := flag.Duration("leak-grace-period", server.DefaultLeakGracePeriod, "The time functions are given to close their outputs once their input is closed (0 to wait forever)")
+	keepaliveTime := flag.Duration("keepalive-time", 0, "The time after which the server pings an inactive connection (0 for the gRPC default of 2h)")
+	keepaliveTimeout := flag.Duration("keepalive-timeout", 0, "The time the server waits for a ping acknowledgement before closing the connection (0 for the gRPC default of 20s)")
+	maxConnectionIdle := flag.Duration("max-connection-idle", 0, "The time after which a connection without streams is closed (0 for no limit)")
+	maxConnectionAge := flag.Duration("max-connection-age", 0, "The time after which a connection is gracefully closed (0 for no limit)")
+	maxConnectionAgeGrace := flag.Duration("max-connection-age-grace", 0, "The time left to streams after the maximum connection age is reached (0 for no limit)")
+	keepaliveMinTime := flag.Duration("keepalive-min-time", 0, "The minimum time clients should wait between pings (0 for the gRPC default of 5m)")
+	keepalivePermitWithoutStream := flag.Bool("keepalive-permit-without-stream", false, "Whether clients may ping connections without streams")
+	metricsPort := flag.Int("metrics-port", 0, "The port metrics are served on as json, at /debug/vars (0 to disable)")
+	compressionThreshold := flag.Int("compression-threshold", server.DefaultCompressionThreshold, "The size (in bytes) from which outgoing payloads are compressed, if accepted (negative to disable compression)")
 
 	flag.Parse()
 
+	if *protocol != server.MessageFunctionProtocol && *protocol != server.RiffRpcProtocol {
+		log.Fatalf("unsupported protocol: %v", *protocol)
+	}
+
 	fnUri := os.Getenv("FUNCTION_URI")
 	if fnUri == "" {
 		log.Fatal("Environment variable $FUNCTION_URI not defined")
 	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", *port))
+	strictJSON, err := boolEnv("FUNCTION_JSON_STRICT")
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		log.Fatal(err)
+	}
+	useNumber, err := boolEnv("FUNCTION_JSON_USE_NUMBER")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config, err := server.LoadConfig(*configEnvPrefix, *configDir)
+	if err != nil {
+		log.Fatalf("failed to load function configuration: %v", err)
+	}
+
+	options := []server.InvokerOption{
+		server.WithConfig(config),
+		server.WithBatching(*batchSize, *batchMaxWait),
+		server.WithStreamNames(names(*inputs), names(*outputs)),
+		server.WithCompressionThreshold(*compressionThreshold),
+		server.WithStrictJSON(strictJSON, useNumber),
+		server.WithRetries(*maxAttempts, *retryBackoff, *retryMaxBackoff),
+		server.WithRateLimits(*streamRate, *globalRate),
+		server.WithConcurrencyLimits(*maxStreams, *maxInFlight),
+		server.WithMaxSendSize(*maxSendSize),
+		server.WithChunking(*chunkSize),
+		server.WithMaxPayloadSize(*maxPayloadSize),
+		server.WithIdleTimeout(*idleTimeout),
+		server.WithLeakGracePeriod(*leakGracePeriod),
+		server.WithInputQueueSize(*inputQueueSize),
+	}
+	if *rejectOverLimit {
+		options = append(options, server.WithLimitRejection())
+	}
+	if *split {
+		options = append(options, server.WithSplitting())
+	}
+	if *cloudEvents {
+		options = append(options, server.WithCloudEvents(*ceSource, *ceType))
+	}
+	if *deadLetterOutput >= 0 {
+		options = append(options, server.WithDeadLetterOutput(*deadLetterOutput))
+	}
+	if *deadLetterFile != "" {
+		f, err := os.OpenFile(*deadLetterFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("failed to open dead-letter file: %v", err)
+		}
+		defer f.Close()
+		options = append(options, server.WithDeadLetterWriter(f))
 	}
 
-	gRpcServer := grpc.NewServer()
-	invoker, err := server.NewInvoker(fnUri)
+	invoker, err := server.NewInvoker(fnUri, options...)
 	if err != nil {
 		panic(err)
 	}
-	function.RegisterMessageFunctionServer(gRpcServer, invoker)
+	if err := invoker.Init(); err != nil {
+		log.Fatalf("failed to initialize function %v: %v", fnUri, err)
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", *port))
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+
+	if *metricsPort != 0 {
+		go func() {
+			// expvar publishes metrics on the default mux
+			log.Println(http.ListenAndServe(fmt.Sprintf(":%d", *metricsPort), nil))
+		}()
+	}
+
+	serverOptions := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:                  *keepaliveTime,
+			Timeout:               *keepaliveTimeout,
+			MaxConnectionIdle:     *maxConnectionIdle,
+			MaxConnectionAge:      *maxConnectionAge,
+			MaxConnectionAgeGrace: *maxConnectionAgeGrace,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             *keepaliveMinTime,
+			PermitWithoutStream: *keepalivePermitWithoutStream,
+		}),
+	}
+	if *maxReceiveSize > 0 {
+		serverOptions = append(serverOptions, grpc.MaxRecvMsgSize(*maxReceiveSize))
+	}
+	if *maxSendSize > 0 {
+		serverOptions = append(serverOptions, grpc.MaxSendMsgSize(*maxSendSize))
+	}
+	gRpcServer := grpc.NewServer(serverOptions...)
+	if *protocol == server.RiffRpcProtocol {
+		rpc.RegisterRiffServer(gRpcServer, invoker)
+	} else {
+		function.RegisterMessageFunctionServer(gRpcServer, invoker)
+	}
 
 	// Handle shutdown gracefully
 	go func() {
@@ -63,4 +195,29 @@ func main() {
 	}()
 
 	gRpcServer.Serve(listener)
+
+	if err := invoker.Destroy(); err != nil {
+		log.Printf("failed to destroy function %v: %v", fnUri, err)
+	}
+}
+
+// boolEnv returns the boolean value of the given environment variable, false if undefined
+func boolEnv(name string) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for environment variable $%v: %v", name, v)
+	}
+	return b, nil
+}
+
+// names splits a comma separated list of names
+func names(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
 }
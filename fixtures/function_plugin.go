@@ -19,10 +19,13 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"time"
 	"strconv"
 	"net/http"
 	"strings"
+	"sync"
 )
 
 func StringInStringOut(in string) (string, error) {
@@ -145,3 +148,211 @@ func Direct8() error {
 func Direct8e() error {
 	return errors.New("Direct8e error")
 }
+
+var greeting = "Hello"
+
+func Init(config map[string]string) error {
+	if g, ok := config["greeting"]; ok {
+		if g == "" {
+			return errors.New("greeting should not be empty")
+		}
+		greeting = g
+	}
+	return nil
+}
+
+func Destroy() error {
+	greeting = "Hello"
+	return nil
+}
+
+func Greet(in string) string {
+	return greeting + " " + in
+}
+
+var Config struct {
+	Punctuation string `config:"punctuation"`
+	Repeat      int    `config:"repeat"`
+}
+
+func Shout(in string) string {
+	return strings.Repeat(strings.ToUpper(in)+Config.Punctuation, Config.Repeat)
+}
+
+// Batched lists the functions that accept batches of inputs
+var Batched = []string{"Tally"}
+
+func Tally(batch []string) ([]int, error) {
+	for _, s := range batch {
+		if s == "Riff" {
+			return nil, errors.New("Riff is not welcome")
+		}
+	}
+	return []int{len(batch)}, nil
+}
+
+func Count(words []string) int {
+	return len(words)
+}
+
+func Tokenize(in string) []string {
+	return strings.Fields(in)
+}
+
+func Spell(in string) <-chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		for _, r := range in {
+			out <- string(r)
+		}
+	}()
+	return out
+}
+
+// Join pairs words and counts received on two inputs, and splits the results into two outputs according to counts parity
+func Join(words <-chan string, counts <-chan int) (<-chan string, <-chan string, <-chan error) {
+	evens := make(chan string)
+	odds := make(chan string)
+	errs := make(chan error)
+	go func() {
+		defer close(evens)
+		defer close(odds)
+		defer close(errs)
+		for w := range words {
+			c, more := <-counts
+			if !more {
+				errs <- fmt.Errorf("no count for %v", w)
+				return
+			}
+			if c%2 == 0 {
+				evens <- strings.Repeat(w, c)
+			} else {
+				odds <- strings.Repeat(w, c)
+			}
+		}
+	}()
+	return evens, odds, errs
+}
+
+type RLEEvent struct {
+	ID     string `ce:"id"`
+	Source string `ce:"source"`
+	Type   string `ce:"type"`
+	Data   RLE    `ce:"data"`
+}
+
+func DescribeEvent(e RLEEvent) string {
+	return fmt.Sprintf("%v %v from %v: %v x%v", e.Type, e.ID, e.Source, e.Data.Word, e.Data.Count)
+}
+
+type AnyEvent struct {
+	Type string      `ce:"type"`
+	Data interface{} `ce:"data"`
+}
+
+func DescribeAnyEvent(e AnyEvent) string {
+	return fmt.Sprintf("%v: %v", e.Type, e.Data)
+}
+
+func Acknowledge(e RLEEvent) RLEEvent {
+	return RLEEvent{Type: "ack", Data: e.Data}
+}
+
+type Item struct {
+	Name     string
+	Quantity int `csv:"qty"`
+}
+
+func Invoice(items <-chan Item) <-chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		for item := range items {
+			out <- fmt.Sprintf("%d %v", item.Quantity, item.Name)
+		}
+	}()
+	return out
+}
+
+var epoch = time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func Elapsed(t time.Time) time.Duration {
+	return t.Sub(epoch)
+}
+
+// flakyError may be marked as permanent, see server.RetryableError
+type flakyError struct {
+	message   string
+	retryable bool
+}
+
+func (e flakyError) Error() string {
+	return e.message
+}
+
+func (e flakyError) Retryable() bool {
+	return e.retryable
+}
+
+var flakyLock sync.Mutex
+var flakyCalls = make(map[string]int)
+
+// Flaky expects inputs of the form "id:n", and fails (with a retryable error) until it has been called n times
+// for a given id. Malformed inputs fail with a permanent error.
+func Flaky(in string) (string, error) {
+	parts := strings.SplitN(in, ":", 2)
+	if len(parts) != 2 {
+		return "", flakyError{message: "malformed input " + in}
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", flakyError{message: err.Error()}
+	}
+	flakyLock.Lock()
+	flakyCalls[parts[0]]++
+	calls := flakyCalls[parts[0]]
+	flakyLock.Unlock()
+	if calls < n {
+		return "", flakyError{message: fmt.Sprintf("attempt #%d failed", calls), retryable: true}
+	}
+	return fmt.Sprintf("%v succeeded after %d attempts", parts[0], calls), nil
+}
+
+// Echo returns the content of r, which may be fed a chunk at a time
+func Echo(r io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
+
+// FlakyReader behaves like Flaky, reading its input from r
+func FlakyReader(r io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return Flaky(string(b))
+}
+
+// Stubborn echoes its input, but never closes its output
+func Stubborn(in <-chan string) <-chan string {
+	out := make(chan string)
+	go func() {
+		for s := range in {
+			out <- s
+		}
+	}()
+	return out
+}
+
+// Unfinished returns a channel holding its input, which it never closes
+func Unfinished(in string) <-chan string {
+	out := make(chan string, 1)
+	out <- in
+	return out
+}
+
+// Nothing returns nil, whatever its input
+func Nothing(in string) interface{} {
+	return nil
+}
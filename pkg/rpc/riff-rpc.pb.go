@@ -0,0 +1,502 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: riff-rpc.proto
+
+/*
+Package rpc is a generated protocol buffer package.
+
+It is generated from these files:
+	riff-rpc.proto
+
+It has these top-level messages:
+	InputSignal
+	OutputSignal
+	StartFrame
+	InputFrame
+	OutputFrame
+*/
+package rpc
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+type InputSignal struct {
+	// Types that are valid to be assigned to Frame:
+	//	*InputSignal_Start
+	//	*InputSignal_Data
+	Frame isInputSignal_Frame `protobuf_oneof:"frame"`
+}
+
+func (m *InputSignal) Reset()                    { *m = InputSignal{} }
+func (m *InputSignal) String() string            { return proto.CompactTextString(m) }
+func (*InputSignal) ProtoMessage()               {}
+func (*InputSignal) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+
+type isInputSignal_Frame interface{ isInputSignal_Frame() }
+
+type InputSignal_Start struct {
+	Start *StartFrame `protobuf:"bytes,1,opt,name=start,oneof"`
+}
+type InputSignal_Data struct {
+	Data *InputFrame `protobuf:"bytes,2,opt,name=data,oneof"`
+}
+
+func (*InputSignal_Start) isInputSignal_Frame() {}
+func (*InputSignal_Data) isInputSignal_Frame()  {}
+
+func (m *InputSignal) GetFrame() isInputSignal_Frame {
+	if m != nil {
+		return m.Frame
+	}
+	return nil
+}
+
+func (m *InputSignal) GetStart() *StartFrame {
+	if x, ok := m.GetFrame().(*InputSignal_Start); ok {
+		return x.Start
+	}
+	return nil
+}
+
+func (m *InputSignal) GetData() *InputFrame {
+	if x, ok := m.GetFrame().(*InputSignal_Data); ok {
+		return x.Data
+	}
+	return nil
+}
+
+// XXX_OneofFuncs is for the internal use of the proto package.
+func (*InputSignal) XXX_OneofFuncs() (func(msg proto.Message, b *proto.Buffer) error, func(msg proto.Message, tag, wire int, b *proto.Buffer) (bool, error), func(msg proto.Message) (n int), []interface{}) {
+	return _InputSignal_OneofMarshaler, _InputSignal_OneofUnmarshaler, _InputSignal_OneofSizer, []interface{}{
+		(*InputSignal_Start)(nil),
+		(*InputSignal_Data)(nil),
+	}
+}
+
+func _InputSignal_OneofMarshaler(msg proto.Message, b *proto.Buffer) error {
+	m := msg.(*InputSignal)
+	// frame
+	switch x := m.Frame.(type) {
+	case *InputSignal_Start:
+		b.EncodeVarint(1<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Start); err != nil {
+			return err
+		}
+	case *InputSignal_Data:
+		b.EncodeVarint(2<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Data); err != nil {
+			return err
+		}
+	case nil:
+	default:
+		return fmt.Errorf("InputSignal.Frame has unexpected type %T", x)
+	}
+	return nil
+}
+
+func _InputSignal_OneofUnmarshaler(msg proto.Message, tag, wire int, b *proto.Buffer) (bool, error) {
+	m := msg.(*InputSignal)
+	switch tag {
+	case 1: // frame.start
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(StartFrame)
+		err := b.DecodeMessage(msg)
+		m.Frame = &InputSignal_Start{msg}
+		return true, err
+	case 2: // frame.data
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(InputFrame)
+		err := b.DecodeMessage(msg)
+		m.Frame = &InputSignal_Data{msg}
+		return true, err
+	default:
+		return false, nil
+	}
+}
+
+func _InputSignal_OneofSizer(msg proto.Message) (n int) {
+	m := msg.(*InputSignal)
+	// frame
+	switch x := m.Frame.(type) {
+	case *InputSignal_Start:
+		s := proto.Size(x.Start)
+		n += proto.SizeVarint(1<<3 | proto.WireBytes)
+		n += proto.SizeVarint(uint64(s))
+		n += s
+	case *InputSignal_Data:
+		s := proto.Size(x.Data)
+		n += proto.SizeVarint(2<<3 | proto.WireBytes)
+		n += proto.SizeVarint(uint64(s))
+		n += s
+	case nil:
+	default:
+		panic(fmt.Sprintf("proto: unexpected type %T in oneof", x))
+	}
+	return n
+}
+
+type OutputSignal struct {
+	// Types that are valid to be assigned to Frame:
+	//	*OutputSignal_Data
+	Frame isOutputSignal_Frame `protobuf_oneof:"frame"`
+}
+
+func (m *OutputSignal) Reset()                    { *m = OutputSignal{} }
+func (m *OutputSignal) String() string            { return proto.CompactTextString(m) }
+func (*OutputSignal) ProtoMessage()               {}
+func (*OutputSignal) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
+type isOutputSignal_Frame interface{ isOutputSignal_Frame() }
+
+type OutputSignal_Data struct {
+	Data *OutputFrame `protobuf:"bytes,1,opt,name=data,oneof"`
+}
+
+func (*OutputSignal_Data) isOutputSignal_Frame() {}
+
+func (m *OutputSignal) GetFrame() isOutputSignal_Frame {
+	if m != nil {
+		return m.Frame
+	}
+	return nil
+}
+
+func (m *OutputSignal) GetData() *OutputFrame {
+	if x, ok := m.GetFrame().(*OutputSignal_Data); ok {
+		return x.Data
+	}
+	return nil
+}
+
+// XXX_OneofFuncs is for the internal use of the proto package.
+func (*OutputSignal) XXX_OneofFuncs() (func(msg proto.Message, b *proto.Buffer) error, func(msg proto.Message, tag, wire int, b *proto.Buffer) (bool, error), func(msg proto.Message) (n int), []interface{}) {
+	return _OutputSignal_OneofMarshaler, _OutputSignal_OneofUnmarshaler, _OutputSignal_OneofSizer, []interface{}{
+		(*OutputSignal_Data)(nil),
+	}
+}
+
+func _OutputSignal_OneofMarshaler(msg proto.Message, b *proto.Buffer) error {
+	m := msg.(*OutputSignal)
+	// frame
+	switch x := m.Frame.(type) {
+	case *OutputSignal_Data:
+		b.EncodeVarint(1<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Data); err != nil {
+			return err
+		}
+	case nil:
+	default:
+		return fmt.Errorf("OutputSignal.Frame has unexpected type %T", x)
+	}
+	return nil
+}
+
+func _OutputSignal_OneofUnmarshaler(msg proto.Message, tag, wire int, b *proto.Buffer) (bool, error) {
+	m := msg.(*OutputSignal)
+	switch tag {
+	case 1: // frame.data
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(OutputFrame)
+		err := b.DecodeMessage(msg)
+		m.Frame = &OutputSignal_Data{msg}
+		return true, err
+	default:
+		return false, nil
+	}
+}
+
+func _OutputSignal_OneofSizer(msg proto.Message) (n int) {
+	m := msg.(*OutputSignal)
+	// frame
+	switch x := m.Frame.(type) {
+	case *OutputSignal_Data:
+		s := proto.Size(x.Data)
+		n += proto.SizeVarint(1<<3 | proto.WireBytes)
+		n += proto.SizeVarint(uint64(s))
+		n += s
+	case nil:
+	default:
+		panic(fmt.Sprintf("proto: unexpected type %T in oneof", x))
+	}
+	return n
+}
+
+type StartFrame struct {
+	ExpectedContentTypes []string `protobuf:"bytes,1,rep,name=expectedContentTypes" json:"expectedContentTypes,omitempty"`
+	InputNames           []string `protobuf:"bytes,2,rep,name=inputNames" json:"inputNames,omitempty"`
+	OutputNames          []string `protobuf:"bytes,3,rep,name=outputNames" json:"outputNames,omitempty"`
+}
+
+func (m *StartFrame) Reset()                    { *m = StartFrame{} }
+func (m *StartFrame) String() string            { return proto.CompactTextString(m) }
+func (*StartFrame) ProtoMessage()               {}
+func (*StartFrame) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+func (m *StartFrame) GetExpectedContentTypes() []string {
+	if m != nil {
+		return m.ExpectedContentTypes
+	}
+	return nil
+}
+
+func (m *StartFrame) GetInputNames() []string {
+	if m != nil {
+		return m.InputNames
+	}
+	return nil
+}
+
+func (m *StartFrame) GetOutputNames() []string {
+	if m != nil {
+		return m.OutputNames
+	}
+	return nil
+}
+
+type InputFrame struct {
+	Payload     []byte            `protobuf:"bytes,1,opt,name=payload,proto3" json:"payload,omitempty"`
+	ContentType string            `protobuf:"bytes,2,opt,name=contentType" json:"contentType,omitempty"`
+	Headers     map[string]string `protobuf:"bytes,3,rep,name=headers" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	ArgIndex    int32             `protobuf:"varint,4,opt,name=argIndex" json:"argIndex,omitempty"`
+}
+
+func (m *InputFrame) Reset()                    { *m = InputFrame{} }
+func (m *InputFrame) String() string            { return proto.CompactTextString(m) }
+func (*InputFrame) ProtoMessage()               {}
+func (*InputFrame) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *InputFrame) GetPayload() []byte {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+func (m *InputFrame) GetContentType() string {
+	if m != nil {
+		return m.ContentType
+	}
+	return ""
+}
+
+func (m *InputFrame) GetHeaders() map[string]string {
+	if m != nil {
+		return m.Headers
+	}
+	return nil
+}
+
+func (m *InputFrame) GetArgIndex() int32 {
+	if m != nil {
+		return m.ArgIndex
+	}
+	return 0
+}
+
+type OutputFrame struct {
+	Payload     []byte            `protobuf:"bytes,1,opt,name=payload,proto3" json:"payload,omitempty"`
+	ContentType string            `protobuf:"bytes,2,opt,name=contentType" json:"contentType,omitempty"`
+	Headers     map[string]string `protobuf:"bytes,3,rep,name=headers" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	ResultIndex int32             `protobuf:"varint,4,opt,name=resultIndex" json:"resultIndex,omitempty"`
+}
+
+func (m *OutputFrame) Reset()                    { *m = OutputFrame{} }
+func (m *OutputFrame) String() string            { return proto.CompactTextString(m) }
+func (*OutputFrame) ProtoMessage()               {}
+func (*OutputFrame) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *OutputFrame) GetPayload() []byte {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+func (m *OutputFrame) GetContentType() string {
+	if m != nil {
+		return m.ContentType
+	}
+	return ""
+}
+
+func (m *OutputFrame) GetHeaders() map[string]string {
+	if m != nil {
+		return m.Headers
+	}
+	return nil
+}
+
+func (m *OutputFrame) GetResultIndex() int32 {
+	if m != nil {
+		return m.ResultIndex
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterType((*InputSignal)(nil), "streaming.InputSignal")
+	proto.RegisterType((*OutputSignal)(nil), "streaming.OutputSignal")
+	proto.RegisterType((*StartFrame)(nil), "streaming.StartFrame")
+	proto.RegisterType((*InputFrame)(nil), "streaming.InputFrame")
+	proto.RegisterType((*OutputFrame)(nil), "streaming.OutputFrame")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// Client API for Riff service
+
+type RiffClient interface {
+	Invoke(ctx context.Context, opts ...grpc.CallOption) (Riff_InvokeClient, error)
+}
+
+type riffClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewRiffClient(cc *grpc.ClientConn) RiffClient {
+	return &riffClient{cc}
+}
+
+func (c *riffClient) Invoke(ctx context.Context, opts ...grpc.CallOption) (Riff_InvokeClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Riff_serviceDesc.Streams[0], c.cc, "/streaming.Riff/Invoke", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &riffInvokeClient{stream}
+	return x, nil
+}
+
+type Riff_InvokeClient interface {
+	Send(*InputSignal) error
+	Recv() (*OutputSignal, error)
+	grpc.ClientStream
+}
+
+type riffInvokeClient struct {
+	grpc.ClientStream
+}
+
+func (x *riffInvokeClient) Send(m *InputSignal) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *riffInvokeClient) Recv() (*OutputSignal, error) {
+	m := new(OutputSignal)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for Riff service
+
+type RiffServer interface {
+	Invoke(Riff_InvokeServer) error
+}
+
+func RegisterRiffServer(s *grpc.Server, srv RiffServer) {
+	s.RegisterService(&_Riff_serviceDesc, srv)
+}
+
+func _Riff_Invoke_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RiffServer).Invoke(&riffInvokeServer{stream})
+}
+
+type Riff_InvokeServer interface {
+	Send(*OutputSignal) error
+	Recv() (*InputSignal, error)
+	grpc.ServerStream
+}
+
+type riffInvokeServer struct {
+	grpc.ServerStream
+}
+
+func (x *riffInvokeServer) Send(m *OutputSignal) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *riffInvokeServer) Recv() (*InputSignal, error) {
+	m := new(InputSignal)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _Riff_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "streaming.Riff",
+	HandlerType: (*RiffServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Invoke",
+			Handler:       _Riff_Invoke_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "riff-rpc.proto",
+}
+
+func init() { proto.RegisterFile("riff-rpc.proto", fileDescriptor0) }
+
+var fileDescriptor0 = []byte{
+	// 448 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x93, 0xcf, 0x6f, 0xd3, 0x30,
+	0x14, 0xc7, 0xe7, 0xfe, 0x58, 0xe9, 0x4b, 0x85, 0x90, 0x35, 0x46, 0xd4, 0x03, 0x8a, 0xc2, 0xa5,
+	0x12, 0x34, 0x45, 0xe1, 0x82, 0x26, 0x10, 0xd2, 0xd0, 0x60, 0xbd, 0x00, 0xca, 0x38, 0x71, 0xf3,
+	0x12, 0x27, 0x33, 0x6d, 0x6d, 0xcb, 0x79, 0x99, 0xd6, 0x2b, 0x7f, 0x28, 0x47, 0xfe, 0x0e, 0x14,
+	0x67, 0x59, 0xac, 0xad, 0x3b, 0xf5, 0x96, 0xf7, 0xf5, 0xc7, 0xdf, 0xf7, 0xbe, 0x76, 0x0c, 0x4f,
+	0x8d, 0xc8, 0xf3, 0xb9, 0xd1, 0x69, 0xa4, 0x8d, 0x42, 0x45, 0xc7, 0x25, 0x1a, 0xce, 0x36, 0x42,
+	0x16, 0xa1, 0x01, 0x6f, 0x29, 0x75, 0x85, 0x17, 0xa2, 0x90, 0x6c, 0x4d, 0xe7, 0x30, 0x2c, 0x91,
+	0x19, 0xf4, 0x49, 0x40, 0x66, 0x5e, 0xfc, 0x3c, 0xba, 0x23, 0xa3, 0x8b, 0x5a, 0xff, 0x62, 0xd8,
+	0x86, 0x9f, 0x1f, 0x24, 0x0d, 0x45, 0x5f, 0xc3, 0x20, 0x63, 0xc8, 0xfc, 0xde, 0x03, 0xda, 0x9a,
+	0xb6, 0xb4, 0x85, 0x4e, 0x47, 0x30, 0xcc, 0x6b, 0x21, 0x3c, 0x83, 0xc9, 0xf7, 0x0a, 0xbb, 0xa6,
+	0x6f, 0x6e, 0x5d, 0x9a, 0x9e, 0xc7, 0x8e, 0x4b, 0x83, 0x3d, 0x62, 0xf3, 0x87, 0x00, 0x74, 0x43,
+	0xd1, 0x18, 0x8e, 0xf8, 0x8d, 0xe6, 0x29, 0xf2, 0xec, 0xb3, 0x92, 0xc8, 0x25, 0xfe, 0xdc, 0x6a,
+	0x5e, 0xfa, 0x24, 0xe8, 0xcf, 0xc6, 0xc9, 0xce, 0x35, 0xfa, 0x12, 0x40, 0xd4, 0x83, 0x7e, 0x63,
+	0x1b, 0x5e, 0xfa, 0x3d, 0x4b, 0x3a, 0x0a, 0x0d, 0xc0, 0x53, 0x15, 0xb6, 0xa5, 0xdf, 0xb7, 0x80,
+	0x2b, 0x85, 0x7f, 0x09, 0x40, 0x97, 0x95, 0xfa, 0x30, 0xd2, 0x6c, 0xbb, 0x56, 0x2c, 0xb3, 0x69,
+	0x26, 0x49, 0x5b, 0xd6, 0x56, 0x69, 0xd7, 0xda, 0x9e, 0xd8, 0x38, 0x71, 0x25, 0xfa, 0x01, 0x46,
+	0x57, 0x9c, 0x65, 0xdc, 0x34, 0x8d, 0xbc, 0x38, 0xdc, 0x79, 0x9e, 0xd1, 0x79, 0x03, 0x9d, 0x49,
+	0x34, 0xdb, 0xa4, 0xdd, 0x42, 0xa7, 0xf0, 0x84, 0x99, 0x62, 0x29, 0x33, 0x7e, 0xe3, 0x0f, 0x02,
+	0x32, 0x1b, 0x26, 0x77, 0xf5, 0xf4, 0x04, 0x26, 0xee, 0x26, 0xfa, 0x0c, 0xfa, 0x2b, 0xbe, 0xb5,
+	0x13, 0x8e, 0x93, 0xfa, 0x93, 0x1e, 0xc1, 0xf0, 0x9a, 0xad, 0xab, 0x76, 0xae, 0xa6, 0x38, 0xe9,
+	0xbd, 0x27, 0xe1, 0x3f, 0x02, 0x9e, 0x73, 0x0d, 0x7b, 0x25, 0xfc, 0x78, 0x3f, 0xe1, 0xab, 0xdd,
+	0x77, 0xfd, 0x48, 0xc4, 0x00, 0x3c, 0xc3, 0xcb, 0x6a, 0x8d, 0x6e, 0x4a, 0x57, 0xda, 0x27, 0x68,
+	0xfc, 0x15, 0x06, 0x89, 0xc8, 0x73, 0xfa, 0x09, 0x0e, 0x97, 0xf2, 0x5a, 0xad, 0x38, 0x3d, 0xbe,
+	0x7f, 0xfe, 0xcd, 0xff, 0x3a, 0x7d, 0xf1, 0x60, 0xea, 0x66, 0x21, 0x3c, 0x98, 0x91, 0xb7, 0xe4,
+	0xf4, 0x07, 0x4c, 0x85, 0xaa, 0x5f, 0xda, 0x6f, 0x9e, 0x62, 0xfd, 0xf2, 0x22, 0x61, 0xfd, 0x4c,
+	0x64, 0x74, 0xfa, 0x2b, 0x2e, 0x04, 0x5e, 0x55, 0x97, 0x51, 0xaa, 0x36, 0x0b, 0x87, 0x59, 0x14,
+	0x6a, 0x9e, 0x57, 0x32, 0x45, 0xa1, 0xe4, 0xfc, 0x96, 0x5f, 0xe8, 0x55, 0xb1, 0x30, 0x3a, 0xbd,
+	0x3c, 0xb4, 0xcf, 0xf6, 0xdd, 0xff, 0x01, 0x00, 0x17, 0x1e, 0x7e, 0x20, 0xc8, 0x03, 0x00, 0x00,
+}
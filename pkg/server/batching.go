@@ -0,0 +1,213 @@
+/*
+ * Copyright 2018-Present the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"plugin"
+	"reflect"
+	"time"
+
+	"github.com/projectriff/go-function-invoker/pkg/function"
+)
+
+// BatchedSymbol is the name of the optional []string variable a plugin may export to list the functions that accept
+// batches of inputs. Only those functions are batched, see WithBatching.
+const BatchedSymbol = "Batched"
+
+// batchError wraps an error returned by a batching function, recording which messages of the input stream
+// (counting from 0) made up the offending batch, and the messages themselves so that they can be dead-lettered.
+type batchError struct {
+	first   int
+	size    int
+	cause   error
+	sources []*function.Message
+}
+
+func (be batchError) Error() string {
+	return fmt.Sprintf("batch of messages #%d to #%d: %v", be.first, be.first+be.size-1, be.cause)
+}
+
+// WithBatching enables batching of inputs for functions that accept a slice and are listed in the BatchedSymbol
+// variable of the plugin (other functions are passed a whole slice per message, as usual). Inputs are collected until either size
+// of them have been received or maxWait has elapsed since the first one (a zero maxWait meaning no time limit).
+// The function is then invoked with the batch, and each element of the slice it returns is sent as its own message.
+// Should the function return an error, each message of the batch is dead-lettered (see WithDeadLetterOutput) and
+// processing goes on with the next batch, or the invocation ends if dead-lettering is not enabled.
+func WithBatching(size int, maxWait time.Duration) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.batchSize = size
+		invoker.batchMaxWait = maxWait
+	}
+}
+
+// lookupBatched tells whether the function is listed in the optional BatchedSymbol variable exported by the plugin.
+// Listed functions must accept a slice.
+func (invoker *pluginInvoker) lookupBatched(lib *plugin.Plugin) error {
+	sym, err := lib.Lookup(BatchedSymbol)
+	if err != nil {
+		return nil
+	}
+	names, ok := sym.(*[]string)
+	if !ok {
+		return fmt.Errorf("exported symbol %v should be a []string variable, was %T", BatchedSymbol, sym)
+	}
+	for _, name := range *names {
+		if name == invoker.handler {
+			fnType := invoker.fn.Type()
+			if fnType.NumIn() != 1 || fnType.In(0).Kind() != reflect.Slice {
+				return fmt.Errorf("function %v is listed in %v but does not accept a slice: %#v", name, BatchedSymbol, invoker.fn)
+			}
+			invoker.batched = true
+		}
+	}
+	return nil
+}
+
+// canonicalizeBatch wraps a function of one of the following forms into the canonical streaming form:
+// f([]X) ([]Y, error)
+// f([]X) []Y
+// f([]X) error
+// f([]X)
+func (invoker *pluginInvoker) canonicalizeBatch() error {
+	oldFn := invoker.fn
+	fnType := oldFn.Type()
+
+	if fnType.NumIn() > 1 {
+		return fmt.Errorf("too many arguments to batching function: %#v", oldFn)
+	}
+	if fnType.NumOut() > 2 {
+		return fmt.Errorf("too many return values for batching function: %#v", oldFn)
+	}
+	inType := fnType.In(0).Elem()
+	invoker.inTypes = []reflect.Type{inType}
+	invoker.outCount = 1
+
+	outType := reflect.TypeOf(struct{}{})
+	if hasReturnValue(oldFn) {
+		if fnType.Out(0).Kind() != reflect.Slice {
+			return fmt.Errorf("batching function should return a slice: %#v", oldFn)
+		}
+		outType = fnType.Out(0).Elem()
+	}
+
+	// Inputs are tagged, so that the messages making up a failed batch can be dead-lettered
+	wrapper := func(args []reflect.Value, done <-chan struct{}) []reflect.Value {
+		in := args[0]
+		out := makeChannel(outType)
+		errs := makeChannel(errorType)
+
+		go func() {
+			defer out.Close()
+			defer errs.Close()
+
+			for received := 0; ; {
+				batch, sources, open := invoker.nextBatch(in, fnType.In(0))
+				if batch.Len() > 0 {
+					Trace.Printf("[-Batch Wrapper->] In function, batch = %#v\n", batch)
+					if err := invoker.admitInvocation(done); err != nil {
+						sendUnlessDone(errs, reflect.ValueOf(&err).Elem(), done)
+						return
+					}
+					fnResult := oldFn.Call([]reflect.Value{batch})
+					invoker.inFlight.release()
+
+					if isErroring(oldFn) && !fnResult[fnType.NumOut()-1].IsNil() {
+						err := batchError{first: received, size: batch.Len(), sources: sources,
+							cause: fnResult[fnType.NumOut()-1].Interface().(error)}
+						Trace.Printf("[-Batch Wrapper->] Sending error %#v", err)
+						if !sendUnlessDone(errs, reflect.ValueOf(err), done) || !invoker.deadLettering() {
+							return
+						}
+					} else if hasReturnValue(oldFn) {
+						for i := 0; i < fnResult[0].Len(); i++ {
+							if !sendUnlessDone(out, fnResult[0].Index(i), done) {
+								return
+							}
+						}
+					}
+					received += batch.Len()
+				}
+				if !open {
+					return
+				}
+			}
+		}()
+		return []reflect.Value{out, errs}
+	}
+
+	cInType := reflect.ChanOf(reflect.RecvDir, taggedType)
+	cOutType := reflect.ChanOf(reflect.BothDir, outType)
+	cErrorType := reflect.ChanOf(reflect.BothDir, errorType)
+	t := reflect.FuncOf([]reflect.Type{cInType}, []reflect.Type{cOutType, cErrorType}, false)
+	invoker.fn = reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value { return wrapper(args, nil) })
+	invoker.wrapper = wrapper
+	invoker.tagged = true
+
+	return nil
+}
+
+// nextBatch reads tagged values from the in channel until a full batch has been collected, the batch max wait time
+// has elapsed or in has been closed. The latter case is signaled by returning open=false, alongside a possibly
+// non-empty batch. The messages the values of the batch come from are returned as sources.
+func (invoker *pluginInvoker) nextBatch(in reflect.Value, sliceType reflect.Type) (batch reflect.Value, sources []*function.Message, open bool) {
+	batch = reflect.MakeSlice(sliceType, 0, invoker.batchSize)
+	add := func(value reflect.Value) {
+		t := value.Interface().(tagged)
+		arg := reflect.Zero(sliceType.Elem())
+		if t.value != nil {
+			arg = reflect.ValueOf(t.value)
+		}
+		batch = reflect.Append(batch, arg)
+		sources = append(sources, t.source)
+	}
+
+	first, open := in.Recv()
+	if !open {
+		return batch, nil, false
+	}
+	add(first)
+
+	cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: in}}
+	if invoker.batchMaxWait > 0 {
+		timer := time.NewTimer(invoker.batchMaxWait)
+		defer timer.Stop()
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)})
+	}
+	for batch.Len() < invoker.batchSize {
+		chosen, value, more := reflect.Select(cases)
+		if chosen == 1 { // max wait time elapsed
+			return batch, sources, true
+		}
+		if !more {
+			return batch, sources, false
+		}
+		add(value)
+	}
+	return batch, sources, true
+}
+
+// deadLetterBatch dead-letters each message of the batch that caused err. A non nil error is returned if one of the
+// dead letters could not be emitted.
+func (pi *pluginInvoker) deadLetterBatch(s *shared, err batchError) error {
+	for _, source := range err.sources {
+		if e := pi.deadLetter(s, source, err); e != nil {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+/*
+ * Copyright 2018-Present the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"reflect"
+)
+
+const (
+	// CBOR major types
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+
+	cborIndefinite = 31
+	cborBreak      = 0xff
+)
+
+var errCborBreak = errors.New("unexpected CBOR break")
+
+// cborMarshalling supports both marshalling and unmarshalling to/from CBOR (RFC 7049). Values are converted to/from
+// their generic json representation (see toGeneric), hence follow golang's json rules and honor `json` struct tags.
+// CBOR byte strings are decoded as base64 strings, so that they can populate []byte fields. Tags are ignored.
+type cborMarshalling struct {
+}
+
+func (*cborMarshalling) supportedMediaTypes(t reflect.Type) []MediaType {
+	return []MediaType{"application/cbor"}
+}
+
+func (*cborMarshalling) marshall(value interface{}, w io.Writer, mediaType MediaType) error {
+	generic, err := toGeneric(value)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if err := writeCbor(bw, generic); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (*cborMarshalling) canUnmarshall(t reflect.Type, mediaType MediaType) bool {
+	contentType, _, err := mime.ParseMediaType(string(mediaType))
+	if err != nil {
+		return false
+	}
+	return contentType == "application/cbor"
+}
+
+func (*cborMarshalling) unmarshall(r io.Reader, t reflect.Type, mediaType MediaType) (interface{}, error) {
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	generic, err := readCbor(bytes.NewReader(payload), 0)
+	if err != nil {
+		return nil, err
+	}
+	return fromGeneric(generic, t)
+}
+
+func writeCbor(w *bufio.Writer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		return w.WriteByte(cborSimple<<5 | 22)
+	case bool:
+		if v {
+			return w.WriteByte(cborSimple<<5 | 21)
+		}
+		return w.WriteByte(cborSimple<<5 | 20)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			if i >= 0 {
+				writeCborHeader(w, cborUint, uint64(i))
+			} else {
+				writeCborHeader(w, cborNegInt, uint64(-1-i))
+			}
+			return nil
+		}
+		if u, ok := parseUint(v); ok {
+			writeCborHeader(w, cborUint, u)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		w.WriteByte(cborSimple<<5 | 27)
+		return binary.Write(w, binary.BigEndian, f)
+	case string:
+		writeCborHeader(w, cborText, uint64(len(v)))
+		_, err := w.WriteString(v)
+		return err
+	case []interface{}:
+		writeCborHeader(w, cborArray, uint64(len(v)))
+		for _, e := range v {
+			if err := writeCbor(w, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		writeCborHeader(w, cborMap, uint64(len(v)))
+		for _, k := range sortedKeys(v) {
+			if err := writeCbor(w, k); err != nil {
+				return err
+			}
+			if err := writeCbor(w, v[k]); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported type for cbor: %T", value)
+	}
+}
+
+// writeCborHeader writes the initial byte(s) of an item of the given major type, using the shortest encoding for n
+func writeCborHeader(w *bufio.Writer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		w.WriteByte(major<<5 | byte(n))
+	case n <= math.MaxUint8:
+		w.Write([]byte{major<<5 | 24, byte(n)})
+	case n <= math.MaxUint16:
+		w.WriteByte(major<<5 | 25)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		w.WriteByte(major<<5 | 26)
+		binary.Write(w, binary.BigEndian, uint32(n))
+	default:
+		w.WriteByte(major<<5 | 27)
+		binary.Write(w, binary.BigEndian, n)
+	}
+}
+
+func readCbor(r *bytes.Reader, depth int) (interface{}, error) {
+	if depth > maxNestingDepth {
+		return nil, fmt.Errorf("values nested more than %d levels deep", maxNestingDepth)
+	}
+	initial, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if initial == cborBreak {
+		return nil, errCborBreak
+	}
+	major, info := initial>>5, initial&0x1f
+
+	if major == cborSimple {
+		return readCborSimple(r, info)
+	}
+
+	var n uint64
+	if info != cborIndefinite {
+		if n, err = readCborArgument(r, info); err != nil {
+			return nil, err
+		}
+	} else if major == cborUint || major == cborNegInt || major == cborTag {
+		return nil, fmt.Errorf("invalid indefinite length for CBOR major type %v", major)
+	}
+
+	switch major {
+	case cborUint:
+		return n, nil
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("CBOR negative integer out of range")
+		}
+		return -1 - int64(n), nil
+	case cborBytes, cborText:
+		b, err := readCborString(r, major, info, n)
+		if err != nil {
+			return nil, err
+		}
+		if major == cborBytes {
+			return base64.StdEncoding.EncodeToString(b), nil
+		}
+		return string(b), nil
+	case cborArray:
+		if err := checkLength(r, n, 1); err != nil {
+			return nil, err
+		}
+		result := []interface{}{}
+		for i := uint64(0); info == cborIndefinite || i < n; i++ {
+			e, err := readCbor(r, depth+1)
+			if err == errCborBreak && info == cborIndefinite {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			result = append(result, e)
+		}
+		return result, nil
+	case cborMap:
+		if err := checkLength(r, n, 2); err != nil {
+			return nil, err
+		}
+		result := make(map[string]interface{})
+		for i := uint64(0); info == cborIndefinite || i < n; i++ {
+			k, err := readCbor(r, depth+1)
+			if err == errCborBreak && info == cborIndefinite {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			v, err := readCbor(r, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			result[fmt.Sprint(k)] = v
+		}
+		return result, nil
+	default: // cborTag, which is ignored
+		return readCbor(r, depth+1)
+	}
+}
+
+// readCborArgument reads the argument of an item, encoded in its additional information and following bytes
+func readCborArgument(r *bytes.Reader, info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info <= 27:
+		return readUint(r, 1<<(info-24))
+	default:
+		return 0, fmt.Errorf("invalid CBOR additional information %v", info)
+	}
+}
+
+// readCborString reads the content of a byte or text string, possibly made of indefinite length chunks
+func readCborString(r *bytes.Reader, major byte, info byte, n uint64) ([]byte, error) {
+	if info != cborIndefinite {
+		if err := checkLength(r, n, 1); err != nil {
+			return nil, err
+		}
+		return readBytes(r, int(n))
+	}
+	var result []byte
+	for {
+		initial, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if initial == cborBreak {
+			return result, nil
+		}
+		if initial>>5 != major || initial&0x1f == cborIndefinite {
+			return nil, errors.New("invalid CBOR indefinite length string chunk")
+		}
+		length, err := readCborArgument(r, initial&0x1f)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := readCborString(r, major, 0, length)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, chunk...)
+	}
+}
+
+func readCborSimple(r *bytes.Reader, info byte) (interface{}, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23: // null, undefined
+		return nil, nil
+	case 25:
+		half, err := readUint(r, 2)
+		return halfToFloat64(uint16(half)), err
+	case 26:
+		var f float32
+		err := binary.Read(r, binary.BigEndian, &f)
+		return float64(f), err
+	case 27:
+		var f float64
+		err := binary.Read(r, binary.BigEndian, &f)
+		return f, err
+	default:
+		return nil, fmt.Errorf("unsupported CBOR simple value %v", info)
+	}
+}
+
+// halfToFloat64 decodes an IEEE 754 half-precision float
+func halfToFloat64(half uint16) float64 {
+	exp := int(half>>10) & 0x1f
+	mant := float64(half & 0x3ff)
+	var value float64
+	switch exp {
+	case 0:
+		value = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			value = math.Inf(1)
+		} else {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mant+1024, exp-25)
+	}
+	if half&0x8000 != 0 {
+		return -value
+	}
+	return value
+}
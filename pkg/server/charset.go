@@ -0,0 +1,174 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
+)
+
+const charsetParam = "charset"
+
+// charsetMarshaller is implemented by marshallers that honor the charset parameter of the media type they are given,
+// and hence can be offered a charset negotiated from the Accept or Accept-Charset headers.
+type charsetMarshaller interface {
+	Marshaller
+	supportsCharset()
+}
+
+// charsetEncoding returns the encoding registered under the given name, looking up IANA names first and WHATWG
+// labels second. UTF-8 (and its US-ASCII subset) is returned as nil, as no transcoding is needed then.
+func charsetEncoding(name string) (encoding.Encoding, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "utf-8", "utf8", "us-ascii":
+		return nil, nil
+	}
+	if e, err := ianaindex.IANA.Encoding(name); err == nil && e != nil {
+		return e, nil
+	}
+	e, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %v", name)
+	}
+	return e, nil
+}
+
+// mediaTypeEncoding returns the encoding designated by the charset parameter of the given media type, if any
+func mediaTypeEncoding(mediaType MediaType) (encoding.Encoding, error) {
+	_, params, err := mime.ParseMediaType(string(mediaType))
+	if err != nil {
+		return nil, err
+	}
+	return charsetEncoding(params[charsetParam])
+}
+
+// isUTF8 returns true if the given media type has no charset parameter, or a UTF-8 one
+func isUTF8(mediaType MediaType) bool {
+	e, err := mediaTypeEncoding(mediaType)
+	return err == nil && e == nil
+}
+
+// decodingReader returns a reader that transcodes r to UTF-8, according to the charset parameter of mediaType
+func decodingReader(r io.Reader, mediaType MediaType) (io.Reader, error) {
+	e, err := mediaTypeEncoding(mediaType)
+	if err != nil || e == nil {
+		return r, err
+	}
+	return transform.NewReader(r, e.NewDecoder()), nil
+}
+
+// writeEncoded writes the UTF-8 bytes b to w, transcoded according to the charset parameter of mediaType.
+// Characters that can't be represented in the target charset result in an error.
+func writeEncoded(w io.Writer, b []byte, mediaType MediaType) error {
+	e, err := mediaTypeEncoding(mediaType)
+	if err != nil {
+		return err
+	}
+	if e != nil {
+		if b, err = e.NewEncoder().Bytes(b); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// withCharset returns mediaType with the given charset parameter, or mediaType itself if charset is empty
+func withCharset(mediaType MediaType, charset string) MediaType {
+	if charset == "" {
+		return mediaType
+	}
+	mt, params, err := mime.ParseMediaType(string(mediaType))
+	if err != nil {
+		return mediaType
+	}
+	params[charsetParam] = strings.ToLower(charset)
+	return MediaType(mime.FormatMediaType(mt, params))
+}
+
+// negotiateCharset returns the charset requested for the given (chosen) media type, as a parameter of the most
+// specific matching media range in accept. An empty string is returned if no particular charset was asked for.
+func negotiateCharset(accept []string, chosen MediaType) string {
+	charset, specificity := "", -1
+	for _, a := range splitAccept(accept) {
+		mt, params, err := mime.ParseMediaType(a)
+		if err != nil || params[charsetParam] == "" {
+			continue
+		}
+		if s := mediaRangeSpecificity(mt, string(chosen)); s > specificity {
+			charset, specificity = params[charsetParam], s
+		}
+	}
+	return charset
+}
+
+// withAcceptCharset folds the preferred supported charset of the given Accept-Charset header values into the media
+// ranges of accept that don't already carry a charset parameter. A nil accept is taken to mean text/plain.
+func withAcceptCharset(accept []string, acceptCharset []string) []string {
+	charset := preferredCharset(acceptCharset)
+	if charset == "" {
+		return accept
+	}
+	if accept == nil {
+		accept = []string{string(AssumedContentType)}
+	}
+	var result []string
+	for _, a := range splitAccept(accept) {
+		mt, params, err := mime.ParseMediaType(a)
+		if err == nil && params[charsetParam] == "" {
+			params[charsetParam] = charset
+			a = mime.FormatMediaType(mt, params)
+		}
+		result = append(result, a)
+	}
+	return result
+}
+
+// preferredCharset returns the supported charset with the highest quality among the given Accept-Charset header
+// values, or an empty string if there is none.
+func preferredCharset(acceptCharset []string) string {
+	charset, quality := "", 0.0
+	for _, a := range splitAccept(acceptCharset) {
+		name, q := withQuality(a)
+		if _, err := charsetEncoding(name); name != "*" && err == nil && q > quality {
+			charset, quality = strings.ToLower(name), q
+		}
+	}
+	return charset
+}
+
+// mediaRangeSpecificity returns how specifically the media range mr matches mediaType: 2 for an exact match, 1 for
+// a type/* match, 0 for */* and -1 if it doesn't match.
+func mediaRangeSpecificity(mr string, mediaType string) int {
+	switch {
+	case mr == mediaType:
+		return 2
+	case strings.HasSuffix(mr, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mr, "*")):
+		return 1
+	case mr == "*/*":
+		return 0
+	default:
+		return -1
+	}
+}
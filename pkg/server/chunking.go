@@ -0,0 +1,293 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/projectriff/go-function-invoker/pkg/function"
+)
+
+const (
+	// Headers of the messages that each carry a chunk of a larger payload, see WithChunking
+	ChunkIndex = "riff-chunk-index" // position of the chunk in the payload, starting at 0
+	ChunkLast  = "riff-chunk-last"  // "true" on the final chunk of the payload
+)
+
+// DefaultMaxPayloadSize is the default maximum size (in bytes) of incoming payloads, once decompressed or reassembled
+// from chunks
+const DefaultMaxPayloadSize = 4 * 1024 * 1024
+
+var readerType = reflect.TypeOf((*io.Reader)(nil)).Elem()
+
+// WithMaxSendSize sets the maximum size (in bytes) of outgoing messages, typically to match the maximum receive size of
+// the sidecar. Larger outputs fail with a MessageTooLarge error, unless chunking is enabled. A size of 0 means unlimited.
+func WithMaxSendSize(size int) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.maxSendSize = size
+	}
+}
+
+// WithMaxPayloadSize sets the maximum size (in bytes) of incoming payloads, once decompressed or reassembled from chunks.
+// Larger payloads fail with a MessageTooLarge error. A size of 0 means unlimited.
+func WithMaxPayloadSize(size int) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.maxPayloadSize = size
+	}
+}
+
+// WithChunking makes outgoing payloads larger than chunkSize (in bytes, once compressed) be split across several
+// messages, each carrying all headers plus ChunkIndex, and ChunkLast on the final one. Incoming chunks are reassembled
+// likewise: streamed to functions accepting an io.Reader as they arrive, or else buffered until complete.
+func WithChunking(chunkSize int) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.chunkSize = chunkSize
+	}
+}
+
+// chunk returns the messages to send in lieu of the given one, that is the message itself or its chunks if it is
+// larger than the chunk size. Messages larger than the maximum send size are reported as an error.
+func (pi *pluginInvoker) chunk(message *function.Message) ([]*function.Message, error) {
+	if pi.chunkSize <= 0 || len(message.Payload) <= pi.chunkSize {
+		return []*function.Message{message}, pi.checkSize(message)
+	}
+	var chunks []*function.Message
+	for start := 0; start < len(message.Payload); start += pi.chunkSize {
+		end := start + pi.chunkSize
+		if end > len(message.Payload) {
+			end = len(message.Payload)
+		}
+		headers := make(map[string]*function.Message_HeaderValue, len(message.Headers)+2)
+		for k, v := range message.Headers {
+			headers[k] = v
+		}
+		headers[ChunkIndex] = &function.Message_HeaderValue{Values: []string{strconv.Itoa(len(chunks))}}
+		if end == len(message.Payload) {
+			headers[ChunkLast] = &function.Message_HeaderValue{Values: []string{"true"}}
+		}
+		chunk := &function.Message{Payload: message.Payload[start:end], Headers: headers}
+		if err := pi.checkSize(chunk); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+// checkSize returns a MessageTooLarge error if the given message exceeds the maximum send size
+func (pi *pluginInvoker) checkSize(message *function.Message) error {
+	if pi.maxSendSize <= 0 {
+		return nil
+	}
+	if size := proto.Size(message); size > pi.maxSendSize {
+		return invokerError{code: MessageTooLarge,
+			message: fmt.Sprintf("Output of %d bytes exceeds the maximum message size of %d bytes", size, pi.maxSendSize)}
+	}
+	return nil
+}
+
+// sendChunks sends the given messages to the sidecar in a row, as coming from the given output, so that the chunks of
+// a payload are not interleaved with other messages (such as dead letters) of that output
+func (s *shared) sendChunks(chunks []*function.Message, output int) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	for _, chunk := range chunks {
+		if err := s.sidecar.Send(chunk, output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkedPayload tracks the reassembly of a payload received in chunks, for a given input
+type chunkedPayload struct {
+	next    int               // the position of the expected chunk
+	size    int               // the size of the payload so far
+	reader  *chunkReader      // set when streaming the payload to an io.Reader input
+	message *function.Message // the headers of the first chunk and the payload so far, otherwise
+}
+
+// chunkToFunctionArgs handles a message carrying a chunk of a larger payload, returning the value(s) to send to the
+// function input at the returned index, if any yet. Chunks destined to an io.Reader input are streamed to the reader
+// handed to the function along with the first chunk. Other chunks are buffered until the last one arrives, at which
+// point the reassembled message is processed as usual and returned, as the message values originate from.
+// Payloads growing beyond the maximum payload size fail with a MessageTooLarge error, which the reader handed to the
+// function (if any) also fails with.
+// Only ever called by the sidecar => function goroutine.
+func (pi *pluginInvoker) chunkToFunctionArgs(s *shared, in *function.Message) (*function.Message, []interface{}, int, error) {
+	var chunkIndex string
+	if values := headerValues(in, ChunkIndex); len(values) > 0 {
+		chunkIndex = values[0]
+	}
+	index, err := pi.inputIndex(in)
+	if err != nil {
+		return in, nil, 0, err
+	}
+	c := s.chunks[index]
+	expected, size := 0, len(in.Payload)
+	if c != nil {
+		expected, size = c.next, c.size+size
+	}
+	position, err := strconv.Atoi(chunkIndex)
+	if err != nil || position != expected {
+		return nil, nil, 0, invokerError{code: ProtocolError,
+			message: fmt.Sprintf("Unexpected chunk %v on input #%d, expecting chunk %d", chunkIndex, index, expected)}
+	}
+	if pi.maxPayloadSize > 0 && size > pi.maxPayloadSize {
+		err := invokerError{code: MessageTooLarge,
+			message: fmt.Sprintf("Chunked payload exceeds the maximum payload size of %d bytes", pi.maxPayloadSize)}
+		if c != nil {
+			if c.reader != nil {
+				c.reader.end(err)
+			}
+			delete(s.chunks, index)
+		}
+		return nil, nil, 0, err
+	}
+	last := len(headerValues(in, ChunkLast)) > 0 && headerValues(in, ChunkLast)[0] == "true"
+
+	var values []interface{}
+	if c == nil {
+		c = &chunkedPayload{}
+		if pi.inTypes[index] == readerType {
+			encodings, err := contentEncodings(in)
+			if err != nil {
+				return in, nil, 0, err
+			}
+			c.reader = newChunkReader(in.Payload)
+			values = []interface{}{readCloser{decompressingReader(c.reader, encodings), c.reader}}
+		} else {
+			c.message = &function.Message{Headers: make(map[string]*function.Message_HeaderValue, len(in.Headers))}
+			for k, v := range in.Headers {
+				if k != ChunkIndex && k != ChunkLast {
+					c.message.Headers[k] = v
+				}
+			}
+		}
+		if s.chunks == nil {
+			s.chunks = make(map[int]*chunkedPayload)
+		}
+		s.chunks[index] = c
+	} else if c.reader != nil {
+		c.reader.feed(in.Payload, s.done)
+	}
+	c.next++
+	c.size = size
+
+	if c.reader != nil {
+		if last {
+			c.reader.end(io.EOF)
+			delete(s.chunks, index)
+		}
+		return nil, values, index, nil
+	}
+	c.message.Payload = append(c.message.Payload, in.Payload...)
+	if !last {
+		return nil, nil, index, nil
+	}
+	delete(s.chunks, index)
+	values, index, err = pi.messageToFunctionArgs(c.message)
+	return c.message, values, index, err
+}
+
+// abortChunks ends the payloads whose reassembly is under way, returning a ProtocolError if there were any.
+// Only ever called by the sidecar => function goroutine.
+func (s *shared) abortChunks() error {
+	if len(s.chunks) == 0 {
+		return nil
+	}
+	for index, c := range s.chunks {
+		if c.reader != nil {
+			c.reader.end(io.ErrUnexpectedEOF)
+		}
+		delete(s.chunks, index)
+	}
+	return invokerError{code: ProtocolError, message: "Input ended in the middle of a chunked payload"}
+}
+
+// chunkReader is the io.Reader handed to functions for payloads received in chunks, which it reads as they arrive.
+// Closing it discards the chunks yet to come.
+type chunkReader struct {
+	chunks    chan []byte
+	current   []byte
+	err       error // returned once all chunks have been read, set before chunks is closed
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newChunkReader(first []byte) *chunkReader {
+	return &chunkReader{chunks: make(chan []byte), current: first, closed: make(chan struct{})}
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.current) == 0 {
+		chunk, more := <-cr.chunks
+		if !more {
+			return 0, cr.err
+		}
+		cr.current = chunk
+	}
+	n := copy(p, cr.current)
+	cr.current = cr.current[n:]
+	return n, nil
+}
+
+func (cr *chunkReader) Close() error {
+	cr.closeOnce.Do(func() {
+		close(cr.closed)
+	})
+	return nil
+}
+
+// feed hands the given chunk to the reader, waiting for it to be read unless the reader is closed, or done is closed
+func (cr *chunkReader) feed(chunk []byte, done <-chan struct{}) {
+	select {
+	case cr.chunks <- chunk:
+	case <-cr.closed:
+	case <-done:
+	}
+}
+
+// end signals that no more chunks are to come, reads then failing with err
+func (cr *chunkReader) end(err error) {
+	cr.err = err
+	close(cr.chunks)
+}
+
+// readCloser marks the readers of (decoded) chunks handed to functions, which get closed once the function returns so
+// as to release the decoders and discard the chunks yet to come
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// readerUnmarshalling hands the raw payload over to functions accepting an io.Reader, whatever its media type
+type readerUnmarshalling struct {
+}
+
+func (*readerUnmarshalling) canUnmarshall(t reflect.Type, mediaType MediaType) bool {
+	return t == readerType
+}
+
+func (*readerUnmarshalling) unmarshall(r io.Reader, t reflect.Type, mediaType MediaType) (interface{}, error) {
+	return r, nil
+}
@@ -0,0 +1,292 @@
+/*
+ * Copyright 2018-Present the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/projectriff/go-function-invoker/pkg/function"
+)
+
+const (
+	// Media type of CloudEvents in structured mode
+	CloudEventsContentType = MediaType("application/cloudevents+json")
+
+	// Prefix of headers that carry CloudEvents context attributes in binary mode
+	CloudEventsHeaderPrefix = "ce-"
+
+	CloudEventsSpecVersion = "1.0"
+
+	DefaultCloudEventSource = "go-function-invoker"
+	DefaultCloudEventType   = "io.projectriff.function.output"
+
+	// Struct tag used to map fields of a CloudEvent envelope type to context attributes, eg `ce:"source"`.
+	// The field tagged `ce:"data"` holds the (unmarshalled) event data.
+	cloudEventTag  = "ce"
+	cloudEventData = "data"
+)
+
+// cloudEvent is the decoded form of an incoming CloudEvent, whose data has yet to be unmarshalled.
+type cloudEvent struct {
+	attributes      map[string]string // context attributes, keyed by name (eg id, source, type, specversion)
+	data            []byte
+	dataContentType MediaType
+}
+
+// WithCloudEvents makes the invoker wrap all outputs as CloudEvents, with the given source and type (unless
+// overridden by a CloudEvent envelope returned by the function). Empty values keep the defaults.
+func WithCloudEvents(source string, eventType string) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.cloudEvents = true
+		if source != "" {
+			invoker.ceSource = source
+		}
+		if eventType != "" {
+			invoker.ceType = eventType
+		}
+	}
+}
+
+// decodeCloudEvent extracts a CloudEvent from the given message, which can be either in structured mode
+// (application/cloudevents+json payload) or in binary mode (ce-* headers). Returns nil if the message
+// is not a CloudEvent.
+func decodeCloudEvent(in *function.Message) (*cloudEvent, error) {
+	contentType := AssumedContentType
+	if ct, ok := in.Headers[ContentType]; ok {
+		contentType = MediaType(ct.Values[0])
+	}
+	if mt, _, err := mime.ParseMediaType(string(contentType)); err == nil && MediaType(mt) == CloudEventsContentType {
+		return decodeStructuredCloudEvent(in.Payload)
+	}
+
+	attributes := make(map[string]string)
+	for k, v := range in.Headers {
+		name := strings.ToLower(k)
+		if strings.HasPrefix(name, CloudEventsHeaderPrefix) && len(v.Values) > 0 {
+			attributes[strings.TrimPrefix(name, CloudEventsHeaderPrefix)] = v.Values[0]
+		}
+	}
+	if attributes["specversion"] == "" {
+		return nil, nil
+	}
+	attributes["datacontenttype"] = string(contentType)
+	return &cloudEvent{attributes: attributes, data: in.Payload, dataContentType: contentType}, nil
+}
+
+func decodeStructuredCloudEvent(payload []byte) (*cloudEvent, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, err
+	}
+
+	event := &cloudEvent{attributes: make(map[string]string, len(fields)), dataContentType: "application/json"}
+	for k, raw := range fields {
+		if k == "data" || k == "data_base64" {
+			continue
+		}
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			event.attributes[k] = s
+		} else {
+			event.attributes[k] = string(raw)
+		}
+	}
+	if event.attributes["specversion"] == "" {
+		return nil, errors.New("missing CloudEvent specversion")
+	}
+	if ct, ok := event.attributes["datacontenttype"]; ok {
+		event.dataContentType = MediaType(ct)
+	}
+
+	if raw, ok := fields["data_base64"]; ok {
+		var encoded string
+		if err := json.Unmarshal(raw, &encoded); err != nil {
+			return nil, err
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		event.data = data
+	} else if raw, ok := fields["data"]; ok {
+		var s string
+		if !isJSONMediaType(event.dataContentType) && json.Unmarshal(raw, &s) == nil {
+			event.data = []byte(s)
+		} else {
+			event.data = raw
+		}
+	}
+	return event, nil
+}
+
+// cloudEventDataField returns the field tagged `ce:"data"` if t is a struct type, in which case t is considered a
+// CloudEvent envelope type.
+func cloudEventDataField(t reflect.Type) (reflect.StructField, bool) {
+	if t == nil || t.Kind() != reflect.Struct {
+		return reflect.StructField{}, false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.Tag.Get(cloudEventTag) == cloudEventData && f.PkgPath == "" {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func isCloudEventEnvelope(t reflect.Type) bool {
+	_, ok := cloudEventDataField(t)
+	return ok
+}
+
+// newCloudEventEnvelope creates an instance of the envelope type t, holding the given data and the context
+// attributes of event (which may be nil if the incoming message was not a CloudEvent).
+func newCloudEventEnvelope(t reflect.Type, event *cloudEvent, data interface{}) interface{} {
+	envelope := reflect.New(t).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get(cloudEventTag)
+		if name == "" || f.PkgPath != "" {
+			continue
+		}
+		if name == cloudEventData {
+			if data != nil { // as for null json data, the field is then left zero
+				envelope.Field(i).Set(reflect.ValueOf(data).Convert(f.Type))
+			}
+		} else if event != nil && f.Type.Kind() == reflect.String {
+			envelope.Field(i).SetString(event.attributes[name])
+		}
+	}
+	return envelope.Interface()
+}
+
+// cloudEventToMessage wraps the given function result as a CloudEvent, in structured mode if explicitly accepted
+// and in binary mode otherwise. If the result is a CloudEvent envelope, its non empty attributes take precedence
+// over the defaults.
+func (invoker *pluginInvoker) cloudEventToMessage(value interface{}, accept []string) (*function.Message, error) {
+	attributes := map[string]string{
+		"id":          newEventId(),
+		"source":      invoker.ceSource,
+		"type":        invoker.ceType,
+		"specversion": CloudEventsSpecVersion,
+		"time":        time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	data := value
+	if isCloudEventEnvelope(reflect.TypeOf(value)) {
+		v := reflect.ValueOf(value)
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			name := f.Tag.Get(cloudEventTag)
+			if name == "" || f.PkgPath != "" {
+				continue
+			}
+			if name == cloudEventData {
+				data = v.Field(i).Interface()
+			} else if f.Type.Kind() == reflect.String && v.Field(i).String() != "" {
+				attributes[name] = v.Field(i).String()
+			}
+		}
+	}
+
+	structured := acceptsCloudEvents(accept)
+	dataAccept := withoutCloudEvents(accept)
+	if structured && len(dataAccept) == 0 {
+		dataAccept = []string{"application/json"}
+	}
+	payload, contentType, err := invoker.marshallValue(data, dataAccept)
+	if err != nil {
+		return nil, err
+	}
+
+	if !structured {
+		headers := map[string]*function.Message_HeaderValue{ContentType: {Values: []string{string(contentType)}}}
+		for k, v := range attributes {
+			headers[CloudEventsHeaderPrefix+k] = &function.Message_HeaderValue{Values: []string{v}}
+		}
+		return &function.Message{Payload: payload, Headers: headers}, nil
+	}
+
+	fields := make(map[string]interface{}, len(attributes)+2)
+	for k, v := range attributes {
+		fields[k] = v
+	}
+	fields["datacontenttype"] = string(contentType)
+	if isJSONMediaType(contentType) && isUTF8(contentType) {
+		fields["data"] = json.RawMessage(payload)
+	} else if strings.HasPrefix(string(contentType), "text/") && isUTF8(contentType) {
+		fields["data"] = string(payload)
+	} else {
+		fields["data_base64"] = base64.StdEncoding.EncodeToString(payload)
+	}
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil, invokerError{code: ErrorWhileMarshalling, cause: err}
+	}
+	return &function.Message{Payload: body,
+		Headers: map[string]*function.Message_HeaderValue{ContentType: {Values: []string{string(CloudEventsContentType)}}}}, nil
+}
+
+// acceptsCloudEvents returns true if the given Accept header values explicitly mention CloudEvents structured mode
+func acceptsCloudEvents(accept []string) bool {
+	return len(withoutCloudEvents(accept)) != len(splitAccept(accept))
+}
+
+// withoutCloudEvents returns the given Accept header values, minus any mention of CloudEvents structured mode
+func withoutCloudEvents(accept []string) []string {
+	var result []string
+	for _, a := range splitAccept(accept) {
+		if mt, _, err := mime.ParseMediaType(a); err != nil || MediaType(mt) != CloudEventsContentType {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// splitAccept splits Accept header values that contain comma separated lists of media ranges
+func splitAccept(accept []string) []string {
+	var result []string
+	for _, a := range accept {
+		for _, part := range strings.Split(a, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				result = append(result, part)
+			}
+		}
+	}
+	return result
+}
+
+// isJSONMediaType returns true for application/json and structured syntax suffix variants (eg application/foo+json)
+func isJSONMediaType(mediaType MediaType) bool {
+	mt, _, err := mime.ParseMediaType(string(mediaType))
+	return err == nil && (mt == "application/json" || strings.HasSuffix(mt, "+json"))
+}
+
+// newEventId generates a random (version 4) UUID
+func newEventId() string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/projectriff/go-function-invoker/pkg/function"
+)
+
+const (
+	GzipEncoding     = "gzip"
+	DeflateEncoding  = "deflate" // zlib wrapped deflate, as per RFC 7230
+	ZstdEncoding     = "zstd"
+	IdentityEncoding = "identity"
+
+	// DefaultCompressionThreshold is the default size (in bytes) from which outgoing payloads get compressed
+	DefaultCompressionThreshold = 1024
+)
+
+// contentCoding compresses and decompresses payloads for a given Content-Encoding
+type contentCoding struct {
+	newReader func(io.Reader) (io.ReadCloser, error)
+	newWriter func(io.Writer) (io.WriteCloser, error)
+}
+
+// contentCodings holds the supported content codings, by name
+var contentCodings = map[string]*contentCoding{
+	GzipEncoding: {
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+	},
+	"x-gzip": {
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+	},
+	DeflateEncoding: {
+		newReader: zlib.NewReader,
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil },
+	},
+	ZstdEncoding: {
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+	},
+}
+
+// WithCompressionThreshold sets the size (in bytes) from which outgoing payloads are compressed, provided the
+// Accept-Encoding header of incoming messages asks for a supported encoding. A negative threshold disables compression.
+func WithCompressionThreshold(threshold int) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.compressionThreshold = threshold
+	}
+}
+
+// contentEncodings returns the content codings listed in the Content-Encoding header of the given message, in the
+// order they need undoing, identity aside. Unsupported codings are reported as an error.
+func contentEncodings(in *function.Message) ([]string, error) {
+	h, ok := in.Headers[ContentEncoding]
+	if !ok {
+		return nil, nil
+	}
+	encodings := splitAccept(h.Values)
+	var result []string
+	for i := len(encodings) - 1; i >= 0; i-- {
+		name := strings.ToLower(encodings[i])
+		if name == IdentityEncoding {
+			continue
+		}
+		if contentCodings[name] == nil {
+			return nil, invokerError{code: ContentEncodingNotSupported, message: "Unsupported Content-Encoding: " + encodings[i]}
+		}
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+// decompress returns the payload of the given message, decoded according to its Content-Encoding header (which may
+// list several encodings, in the order they were applied). Payloads decoding to more than limit bytes are reported as
+// a MessageTooLarge error, rather than exhausting memory. A limit of 0 means unlimited.
+func decompress(in *function.Message, limit int) ([]byte, error) {
+	encodings, err := contentEncodings(in)
+	if err != nil {
+		return nil, err
+	}
+	payload := in.Payload
+	for _, name := range encodings {
+		r, err := contentCodings[name].newReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, invokerError{code: ErrorWhileUnmarshalling, cause: fmt.Errorf("invalid %v payload: %v", name, err)}
+		}
+		var limited io.Reader = r
+		if limit > 0 {
+			limited = io.LimitReader(r, int64(limit)+1)
+		}
+		payload, err = ioutil.ReadAll(limited)
+		r.Close()
+		if err != nil {
+			return nil, invokerError{code: ErrorWhileUnmarshalling, cause: fmt.Errorf("invalid %v payload: %v", name, err)}
+		}
+		if limit > 0 && len(payload) > limit {
+			return nil, invokerError{code: MessageTooLarge,
+				message: fmt.Sprintf("Decompressed payload exceeds the maximum payload size of %d bytes", limit)}
+		}
+	}
+	return payload, nil
+}
+
+// decompressingReader returns a reader of the content of r, decoded according to the given content codings (as
+// returned by contentEncodings). Decoders are only set up on first read, as they consume some of r right away.
+// Closing the returned reader closes the decoders, then r.
+func decompressingReader(r io.ReadCloser, encodings []string) io.ReadCloser {
+	if len(encodings) == 0 {
+		return r
+	}
+	return &lazyReader{underlying: r, init: func() ([]io.ReadCloser, error) {
+		var decoders []io.ReadCloser
+		var decoded io.Reader = r
+		for _, name := range encodings {
+			d, err := contentCodings[name].newReader(decoded)
+			if err != nil {
+				return decoders, fmt.Errorf("invalid %v payload: %v", name, err)
+			}
+			decoders = append(decoders, d)
+			decoded = d
+		}
+		return decoders, nil
+	}}
+}
+
+// lazyReader defers the creation of the decoders it reads through until the first call to Read
+type lazyReader struct {
+	underlying io.ReadCloser
+	init       func() ([]io.ReadCloser, error)
+	decoders   []io.ReadCloser // the last one decodes the fully decoded content
+	started    bool
+	err        error
+}
+
+func (lr *lazyReader) Read(p []byte) (int, error) {
+	if !lr.started {
+		lr.started = true
+		lr.decoders, lr.err = lr.init()
+	}
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	return lr.decoders[len(lr.decoders)-1].Read(p)
+}
+
+func (lr *lazyReader) Close() error {
+	for i := len(lr.decoders) - 1; i >= 0; i-- {
+		lr.decoders[i].Close()
+	}
+	return lr.underlying.Close()
+}
+
+// compress encodes the payload of the given message according to the preferred supported encoding of the given
+// Accept-Encoding header values, provided the payload is at least as large as the compression threshold.
+func (pi *pluginInvoker) compress(message *function.Message, acceptEncoding []string) error {
+	if pi.compressionThreshold < 0 || len(message.Payload) < pi.compressionThreshold {
+		return nil
+	}
+	name := preferredEncoding(acceptEncoding)
+	if name == "" {
+		return nil
+	}
+	var buffer bytes.Buffer
+	w, err := contentCodings[name].newWriter(&buffer)
+	if err != nil {
+		return invokerError{code: ErrorWhileMarshalling, cause: err}
+	}
+	if _, err := w.Write(message.Payload); err != nil {
+		return invokerError{code: ErrorWhileMarshalling, cause: err}
+	}
+	if err := w.Close(); err != nil {
+		return invokerError{code: ErrorWhileMarshalling, cause: err}
+	}
+	message.Payload = buffer.Bytes()
+	message.Headers[ContentEncoding] = &function.Message_HeaderValue{Values: []string{name}}
+	return nil
+}
+
+// preferredEncoding returns the supported content coding with the highest quality among the given Accept-Encoding
+// header values (with a wildcard standing for gzip), or an empty string if the payload should be left as is.
+func preferredEncoding(acceptEncoding []string) string {
+	encoding, quality := "", 0.0
+	for _, a := range splitAccept(acceptEncoding) {
+		name, q := withQuality(a)
+		name = strings.ToLower(name)
+		if name == "*" {
+			name = GzipEncoding
+		}
+		if name == IdentityEncoding || contentCodings[name] != nil {
+			if q > quality {
+				encoding, quality = name, q
+			}
+		}
+	}
+	if encoding == IdentityEncoding {
+		return ""
+	}
+	return encoding
+}
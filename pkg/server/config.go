@@ -0,0 +1,156 @@
+/*
+ * Copyright 2018-Present the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"plugin"
+	"reflect"
+	"strings"
+)
+
+const (
+	// Optional struct variable exported by the plugin, filled from the function configuration
+	ConfigSymbol = "Config"
+
+	// Struct tag used on fields of the ConfigSymbol struct, of the form `config:"key[,required]"`
+	configTag = "config"
+)
+
+// LoadConfig collects function configuration from environment variables starting with envPrefix (the prefix being
+// stripped to form the key) and from the files found in dir (the file name being the key and its content the value),
+// as mounted from a kubernetes ConfigMap for example. Files take precedence over environment variables.
+// An empty envPrefix or dir disables the corresponding source.
+func LoadConfig(envPrefix string, dir string) (map[string]string, error) {
+	result := make(map[string]string)
+
+	if envPrefix != "" {
+		for _, kv := range os.Environ() {
+			if strings.HasPrefix(kv, envPrefix) {
+				parts := strings.SplitN(strings.TrimPrefix(kv, envPrefix), "=", 2)
+				if parts[0] != "" {
+					result[parts[0]] = parts[1]
+				}
+			}
+		}
+	}
+
+	if dir != "" {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			// Skip hidden files, which includes the ..data links maintained by kubernetes
+			if strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			path := filepath.Join(dir, f.Name())
+			info, err := os.Stat(path) // follow symlinks
+			if err != nil {
+				return nil, err
+			}
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			result[f.Name()] = strings.TrimSuffix(string(content), "\n")
+		}
+	}
+
+	return result, nil
+}
+
+// WithConfig adds the given configuration to the one passed to the plugin, overriding the function URI parameters.
+func WithConfig(config map[string]string) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		for k, v := range config {
+			invoker.config[k] = v
+		}
+	}
+}
+
+// lookupConfigStruct resolves the optional ConfigSymbol variable exported by the plugin, which must be a struct.
+func (invoker *pluginInvoker) lookupConfigStruct(lib *plugin.Plugin) error {
+	sym, err := lib.Lookup(ConfigSymbol)
+	if err != nil {
+		return nil
+	}
+	v := reflect.ValueOf(sym)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("exported symbol %v should be a struct variable, was %T", ConfigSymbol, sym)
+	}
+	invoker.configStruct = v.Elem()
+	return nil
+}
+
+// fillConfigStruct sets the fields of the ConfigSymbol struct (if any) that carry a `config` tag, converting values
+// according to the text/plain unmarshalling rules. Missing required fields are all reported at once.
+func (invoker *pluginInvoker) fillConfigStruct() error {
+	if !invoker.configStruct.IsValid() {
+		return nil
+	}
+	return fillStruct(invoker.configStruct, invoker.config)
+}
+
+func fillStruct(target reflect.Value, config map[string]string) error {
+	var missing []string
+	text := &textMarshalling{}
+	t := target.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, ok := field.Tag.Lookup(configTag)
+		if !ok || tag == "-" {
+			continue
+		}
+		if field.PkgPath != "" {
+			return fmt.Errorf("configuration field %v should be exported", field.Name)
+		}
+		parts := strings.Split(tag, ",")
+		key := parts[0]
+		if key == "" {
+			key = field.Name
+		}
+		required := len(parts) > 1 && parts[1] == "required"
+
+		value, present := config[key]
+		if !present {
+			if required {
+				missing = append(missing, key)
+			}
+			continue
+		}
+		if !text.canUnmarshall(field.Type, AssumedContentType) {
+			return fmt.Errorf("unsupported type %v for configuration field %v", field.Type, field.Name)
+		}
+		converted, err := text.unmarshall(strings.NewReader(value), field.Type, AssumedContentType)
+		if err != nil {
+			return fmt.Errorf("invalid value for configuration key %v: %v", key, err)
+		}
+		target.Field(i).Set(reflect.ValueOf(converted).Convert(field.Type))
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required configuration: %v", strings.Join(missing, ", "))
+	}
+	return nil
+}
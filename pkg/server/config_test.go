@@ -0,0 +1,75 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+
+	Context("when loading configuration", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			os.Setenv("TEST_CONFIG_user", "env-user")
+			os.Setenv("TEST_CONFIG_password", "env-password")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+			os.Unsetenv("TEST_CONFIG_user")
+			os.Unsetenv("TEST_CONFIG_password")
+		})
+
+		It("should read prefixed environment variables", func() {
+			config, err := LoadConfig("TEST_CONFIG_", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config).To(Equal(map[string]string{"user": "env-user", "password": "env-password"}))
+		})
+
+		It("should read files, which take precedence", func() {
+			Expect(ioutil.WriteFile(filepath.Join(dir, "password"), []byte("s3cr3t\n"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, ".hidden"), []byte("ignored"), 0644)).To(Succeed())
+			Expect(os.Mkdir(filepath.Join(dir, "..data"), 0755)).To(Succeed())
+
+			config, err := LoadConfig("TEST_CONFIG_", dir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config).To(Equal(map[string]string{"user": "env-user", "password": "s3cr3t"}))
+		})
+
+		It("should report a missing directory", func() {
+			_, err := LoadConfig("", filepath.Join(dir, "missing"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when filling a struct", func() {
+		type target struct {
+			Host    string  `config:"host,required"`
+			Port    int     `config:"port,required"`
+			Ratio   float64 `config:"ratio"`
+			Ignored string
+		}
+
+		It("should convert values", func() {
+			var t target
+			err := fillStruct(reflect.ValueOf(&t).Elem(), map[string]string{"host": "localhost", "port": "8080", "ratio": "0.5", "Ignored": "x"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(t).To(Equal(target{Host: "localhost", Port: 8080, Ratio: 0.5}))
+		})
+
+		It("should report all missing required fields", func() {
+			var t target
+			err := fillStruct(reflect.ValueOf(&t).Elem(), map[string]string{"ratio": "0.5"})
+			Expect(err).To(MatchError("missing required configuration: host, port"))
+		})
+	})
+})
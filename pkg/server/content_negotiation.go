@@ -18,21 +18,105 @@ package server
 
 import (
 	"github.com/golang/gddo/httputil"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 // bestMarshaller inspects the provided map of Marshallers and the incoming Message's Accept header,
 // and returns the marshaller (and mediaType) that best fits one of the accepted media type.
+// Offers are the keys of marshallers, in order of preference for equally acceptable media types.
 // If no match is found, (nil, "") is returned.
-func bestMarshaller(accept []string, marshallers map[MediaType]Marshaller) (Marshaller, MediaType) {
+func bestMarshaller(accept []string, offers []MediaType, marshallers map[MediaType]Marshaller) (Marshaller, MediaType) {
 	if accept == nil {
 		accept = []string{"text/plain"}
 	}
-	fakeRequest := http.Request{Header: http.Header{"Accept": accept}}
-	offers := make([]string, 0, len(marshallers))
-	for o, _ := range marshallers {
-		offers = append(offers, string(o))
+	fakeRequest := http.Request{Header: http.Header{"Accept": withoutParameters(accept)}}
+	stringOffers := make([]string, 0, len(offers))
+	for _, o := range offers {
+		stringOffers = append(stringOffers, string(o))
 	}
-	chosenMediaType := MediaType(httputil.NegotiateContentType(&fakeRequest, offers, ""))
+	chosenMediaType := MediaType(httputil.NegotiateContentType(&fakeRequest, stringOffers, ""))
 	return marshallers[chosenMediaType], chosenMediaType
 }
+
+// withoutParameters strips media ranges of all parameters but quality, as they would otherwise be ignored altogether
+// by httputil. Parameters such as charset are honored separately, see negotiateCharset.
+func withoutParameters(accept []string) []string {
+	var result []string
+	for _, a := range splitAccept(accept) {
+		mt, params, err := mime.ParseMediaType(a)
+		if err != nil {
+			result = append(result, a)
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			mt += ";q=" + q
+		}
+		result = append(result, mt)
+	}
+	return result
+}
+
+// withQuality splits an element of an Accept-* header (such as "gzip;q=0.5") into its value and quality,
+// which defaults to 1.
+func withQuality(element string) (string, float64) {
+	parts := strings.Split(element, ";")
+	value, q := strings.TrimSpace(parts[0]), 1.0
+	for _, p := range parts[1:] {
+		if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+			q, _ = strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		}
+	}
+	return value, q
+}
+
+// structuredSuffixes maps structured syntax suffixes (RFC 6839) onto the media type they stand for
+var structuredSuffixes = map[string]MediaType{
+	"+json":  "application/json",
+	"+xml":   "application/xml",
+	"+proto": ProtobufContentType,
+}
+
+// suffixBase returns the media type that the structured syntax suffix of mediaType stands for (as in
+// application/json for application/vnd.acme.order+json), keeping parameters as is. An empty string is returned
+// if mediaType has no known suffix.
+func suffixBase(mediaType MediaType) MediaType {
+	mt, params, err := mime.ParseMediaType(string(mediaType))
+	if err != nil {
+		return ""
+	}
+	plus := strings.LastIndex(mt, "+")
+	if plus < 0 {
+		return ""
+	}
+	base, ok := structuredSuffixes[mt[plus:]]
+	if !ok {
+		return ""
+	}
+	if len(params) == 0 {
+		return base
+	}
+	return MediaType(mime.FormatMediaType(string(base), params))
+}
+
+// withSuffixOffers returns offers, preceded by the media types of accept that have a structured syntax suffix
+// standing for one of the offers. Those are added to marshallers, so that a vendor type asked for is echoed back.
+func withSuffixOffers(accept []string, offers []MediaType, marshallers map[MediaType]Marshaller) []MediaType {
+	var result []MediaType
+	for _, a := range splitAccept(accept) {
+		mt, _, err := mime.ParseMediaType(a)
+		if err != nil {
+			continue
+		}
+		if _, present := marshallers[MediaType(mt)]; present {
+			continue
+		}
+		if m, ok := marshallers[suffixBase(MediaType(mt))]; ok {
+			marshallers[MediaType(mt)] = m
+			result = append(result, MediaType(mt))
+		}
+	}
+	return append(result, offers...)
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/projectriff/go-function-invoker/pkg/function"
+)
+
+const (
+	// Headers added to dead letters, on top of Error (which holds the error code)
+	ErrorCause     = "riff-error-cause"
+	Attempts       = "riff-attempts"
+	ErrorTimestamp = "riff-error-timestamp"
+)
+
+// WithDeadLetterOutput makes messages that fail unmarshalling or invocation be emitted on the given output index
+// (typically one past the function outputs), rather than aborting the invocation. See deadLetter.
+func WithDeadLetterOutput(index int) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.deadLetterOutput = index
+	}
+}
+
+// WithDeadLetterWriter makes messages that fail unmarshalling or invocation be written to w (typically a file, for
+// local runs), rather than aborting the invocation. Each dead letter is written as the json representation of a
+// function.Message, on its own line. See deadLetter.
+func WithDeadLetterWriter(w io.Writer) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.deadLetterWriter = w
+	}
+}
+
+// deadLettering returns true if failing messages should be dead-lettered
+func (pi *pluginInvoker) deadLettering() bool {
+	return pi.deadLetterOutput >= 0 || pi.deadLetterWriter != nil
+}
+
+// deadLetter emits the given incoming message, whose processing failed because of cause, to the dead-letter output
+// and/or writer. The original payload and headers are kept as is, and error headers are added. A non nil error is
+// returned if the dead letter could not be emitted.
+func (pi *pluginInvoker) deadLetter(s *shared, in *function.Message, cause error) error {
+	code, attempts := InvocationError, 1
+	if ie, ok := cause.(invokerError); ok {
+		code = ie.code
+		if ie.attempts > 0 {
+			attempts = ie.attempts
+		}
+	}
+	headers := make(map[string]*function.Message_HeaderValue, len(in.Headers)+4)
+	for k, v := range in.Headers {
+		headers[k] = v
+	}
+	headers[Error] = &function.Message_HeaderValue{Values: []string{string(code)}}
+	headers[ErrorCause] = &function.Message_HeaderValue{Values: []string{cause.Error()}}
+	headers[Attempts] = &function.Message_HeaderValue{Values: []string{strconv.Itoa(attempts)}}
+	headers[ErrorTimestamp] = &function.Message_HeaderValue{Values: []string{time.Now().UTC().Format(time.RFC3339Nano)}}
+	letter := &function.Message{Payload: in.Payload, Headers: headers}
+	Trace.Printf("[Dead letter] Emitting %v\n", letter)
+
+	if pi.deadLetterWriter != nil {
+		line, err := json.Marshal(letter)
+		if err != nil {
+			return err
+		}
+		pi.deadLetterLock.Lock()
+		_, err = pi.deadLetterWriter.Write(append(line, '\n'))
+		pi.deadLetterLock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if pi.deadLetterOutput >= 0 {
+		return s.send(letter, pi.deadLetterOutput)
+	}
+	return nil
+}
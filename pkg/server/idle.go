@@ -0,0 +1,97 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"io"
+	"time"
+
+	"github.com/projectriff/go-function-invoker/pkg/function"
+)
+
+// WithIdleTimeout makes the input of a stream end when no message has arrived on it for the given duration, so that
+// streaming functions get a chance to flush their state and exit. A timeout of 0 means no timeout.
+func WithIdleTimeout(timeout time.Duration) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.idleTimeout = timeout
+	}
+}
+
+// received is the outcome of a call to messageStream.Recv
+type received struct {
+	message *function.Message
+	err     error
+}
+
+// idleStream is a messageStream whose input ends (as if the sidecar had closed it) once no message has arrived for
+// a given duration. Messages are received by a separate goroutine, so that waiting for them can time out.
+type idleStream struct {
+	messageStream
+	timeout  time.Duration
+	received chan received
+	stopped  chan struct{}
+	timer    *time.Timer // only ever used by the goroutine calling Recv
+}
+
+func newIdleStream(stream messageStream, timeout time.Duration) *idleStream {
+	is := &idleStream{
+		messageStream: stream,
+		timeout:       timeout,
+		received:      make(chan received),
+		stopped:       make(chan struct{}),
+		timer:         time.NewTimer(timeout),
+	}
+	go is.pump()
+	return is
+}
+
+func (is *idleStream) Recv() (*function.Message, error) {
+	select {
+	case r := <-is.received:
+		if !is.timer.Stop() {
+			select {
+			case <-is.timer.C:
+			default:
+			}
+		}
+		is.timer.Reset(is.timeout)
+		return r.message, r.err
+	case <-is.timer.C:
+		Trace.Printf("[Sidecar -> Function] No message received for %v, ending input\n", is.timeout)
+		return nil, io.EOF
+	}
+}
+
+// pump receives messages from the underlying stream until it fails or ends, or the idleStream is stopped
+func (is *idleStream) pump() {
+	for {
+		message, err := is.messageStream.Recv()
+		select {
+		case is.received <- received{message, err}:
+		case <-is.stopped:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// stop releases the receiving goroutine, once the invocation is over. Any message received from then on is dropped.
+func (is *idleStream) stop() {
+	close(is.stopped)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"sync"
+)
+
+// inputQueue holds the values received for one input of a function with several inputs, until the function reads
+// them. Functions may read their inputs in any order (say, in lockstep), while messages for the different inputs
+// arrive interleaved on a single stream: sending them to the function in arrival order, one at a time, would
+// deadlock as soon as the function waits on another input than that of the next value. Each input is thus fed by
+// its own goroutine, from a queue that grows with the values the function has not read yet, up to its capacity.
+type inputQueue struct {
+	lock     sync.Mutex
+	values   []interface{}
+	capacity int // the maximum number of values held, 0 for unbounded
+	closed   bool
+	changed  chan struct{} // signalled (without blocking) when values are pushed, or the queue is closed
+	taken    chan struct{} // signalled (without blocking) when values are taken, making room for more
+}
+
+// DefaultInputQueueSize is the default number of values queued for each input of a function with several inputs
+const DefaultInputQueueSize = 1000
+
+// WithInputQueueSize sets the number of values queued for each input of a function with several inputs, until the
+// function reads them (see inputQueue). Once the queue of an input is full, messages are no longer received from the
+// stream until the function reads that input: a function that waits on another input in the meantime thus stalls
+// the stream, rather than making the queue grow without limit. A size of 0 means unbounded queues.
+func WithInputQueueSize(size int) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.inputQueueSize = size
+	}
+}
+
+func newInputQueue(capacity int) *inputQueue {
+	return &inputQueue{capacity: capacity, changed: make(chan struct{}, 1), taken: make(chan struct{}, 1)}
+}
+
+// push appends the given values to the queue, waiting for room to be made if it is full. It returns false if done
+// was closed before all values could be queued.
+func (q *inputQueue) push(values []interface{}, done <-chan struct{}) bool {
+	for {
+		q.lock.Lock()
+		n := len(values)
+		if q.capacity > 0 && n > q.capacity-len(q.values) {
+			n = q.capacity - len(q.values)
+		}
+		q.values = append(q.values, values[:n]...)
+		q.lock.Unlock()
+		values = values[n:]
+		if n > 0 {
+			signal(q.changed)
+		}
+		if len(values) == 0 {
+			return true
+		}
+		select {
+		case <-q.taken:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// close marks the end of the values to come, dropping the values still queued if discard is true
+func (q *inputQueue) close(discard bool) {
+	q.lock.Lock()
+	q.closed = true
+	if discard {
+		q.values = nil
+	}
+	q.lock.Unlock()
+	signal(q.changed)
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// take removes and returns the values queued so far, waiting for some to be pushed. It returns false once the queue
+// is closed and empty.
+func (q *inputQueue) take() ([]interface{}, bool) {
+	for {
+		q.lock.Lock()
+		values, closed := q.values, q.closed
+		q.values = nil
+		q.lock.Unlock()
+		if len(values) > 0 {
+			signal(q.taken)
+			return values, true
+		}
+		if closed {
+			return nil, false
+		}
+		<-q.changed
+	}
+}
+
+// startQueues sets up a queue for each function input, along with the goroutine sending its values to the function.
+// Each input is closed once its queue is closed and drained, or cancellation happens.
+// Each queue holds at most size values, 0 meaning unbounded.
+func (s *shared) startQueues(size int) {
+	var feeding sync.WaitGroup
+	s.queues = make([]*inputQueue, len(s.inputs))
+	for i := range s.inputs {
+		s.queues[i] = newInputQueue(size)
+		feeding.Add(1)
+		go func(index int) {
+			defer feeding.Done()
+			defer s.inputs[index].Close()
+			for {
+				values, more := s.queues[index].take()
+				if !more || !s.sendToInput(values, index) {
+					return
+				}
+			}
+		}(i)
+	}
+	go func() {
+		feeding.Wait()
+		close(s.inputsClosed)
+	}()
+}
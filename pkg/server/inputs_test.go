@@ -0,0 +1,72 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Input queues", func() {
+
+	It("should block pushes once full, until values are taken", func() {
+		q := newInputQueue(2)
+		done := make(chan struct{})
+		Expect(q.push([]interface{}{"a", "b"}, done)).To(BeTrue())
+
+		pushed := make(chan bool)
+		go func() {
+			pushed <- q.push([]interface{}{"c", "d", "e"}, done)
+		}()
+		Consistently(pushed).ShouldNot(Receive())
+
+		values, more := q.take()
+		Expect(more).To(BeTrue())
+		Expect(values).To(Equal([]interface{}{"a", "b"}))
+		Consistently(pushed).ShouldNot(Receive())
+
+		values, _ = q.take()
+		Expect(values).To(Equal([]interface{}{"c", "d"}))
+		Eventually(pushed).Should(Receive(BeTrue()))
+		values, _ = q.take()
+		Expect(values).To(Equal([]interface{}{"e"}))
+	})
+
+	It("should give up pushing once done is closed", func() {
+		q := newInputQueue(1)
+		done := make(chan struct{})
+		Expect(q.push([]interface{}{"a"}, done)).To(BeTrue())
+
+		pushed := make(chan bool)
+		go func() {
+			pushed <- q.push([]interface{}{"b"}, done)
+		}()
+		Consistently(pushed).ShouldNot(Receive())
+
+		close(done)
+		Eventually(pushed).Should(Receive(BeFalse()))
+	})
+
+	It("should not bound queues of size 0", func() {
+		q := newInputQueue(0)
+		values := make([]interface{}, 10*DefaultInputQueueSize)
+		Expect(q.push(values, make(chan struct{}))).To(BeTrue())
+
+		taken, _ := q.take()
+		Expect(taken).To(HaveLen(len(values)))
+	})
+})
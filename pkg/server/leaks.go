@@ -0,0 +1,73 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"time"
+)
+
+// DefaultLeakGracePeriod is the default time functions are given to close their outputs once their input is closed,
+// that is forever: detecting leaks is opt-in, as functions may legitimately keep producing outputs for a long time.
+const DefaultLeakGracePeriod = time.Duration(0)
+
+var Warning *log.Logger // exported so the main package can redirect output
+
+func init() {
+	Warning = log.New(os.Stderr, "WARNING: ", log.LstdFlags)
+}
+
+// WithLeakGracePeriod sets the time a function is given to close its output (and error) channels once its input is
+// closed. Past that time, the function is deemed to leak goroutines: a warning is logged along with a goroutine dump,
+// and the invocation ends with an error, rather than waiting forever. The goroutines of the invoker feeding the outputs
+// of 'direct' functions are then released, those of the function itself can't be. A period of 0 means waiting forever.
+func WithLeakGracePeriod(period time.Duration) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.leakGracePeriod = period
+	}
+}
+
+// abandon gives up on a function that did not close its outputs in time, returning the error that ends the invocation.
+// Goroutines are only dumped if the stream had not failed already, as functions are then likely to have stopped
+// reading their input, or to be blocked on an output no longer read, for reasons that are already reported.
+func (pi *pluginInvoker) abandon(failed bool) error {
+	metrics.Add(leakedFunctionsMetric, 1)
+	if failed {
+		Warning.Printf("Function %v did not close its outputs within %v of its input closing, after the stream failed, abandoning it\n",
+			pi.handler, pi.leakGracePeriod)
+	} else {
+		Warning.Printf("Function %v did not close its outputs within %v of its input closing, abandoning it. Goroutines:\n%s",
+			pi.handler, pi.leakGracePeriod, goroutineDump())
+	}
+	return invokerError{code: InvocationError,
+		message: fmt.Sprintf("Function did not close its outputs within %v of its input closing", pi.leakGracePeriod)}
+}
+
+// goroutineDump returns the stack traces of all goroutines
+func goroutineDump() []byte {
+	buffer := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buffer, true)
+		if n < len(buffer) {
+			return buffer[:n]
+		}
+		buffer = make([]byte, 2*len(buffer))
+	}
+}
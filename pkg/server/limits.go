@@ -0,0 +1,195 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WithRateLimits bounds the rate of incoming messages, in messages per second, for each stream and across all streams.
+// A rate of 0 means unlimited. Bursts of up to one second worth of messages are allowed.
+func WithRateLimits(perStream float64, global float64) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.streamRate = perStream
+		invoker.globalBucket = newTokenBucket(global)
+	}
+}
+
+// WithConcurrencyLimits bounds the number of concurrent streams, and the number of concurrent invocations of 'direct'
+// and batching functions. A limit of 0 means unlimited.
+func WithConcurrencyLimits(maxStreams int, maxInFlight int) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.streams = newSemaphore(maxStreams)
+		invoker.inFlight = newSemaphore(maxInFlight)
+	}
+}
+
+// WithLimitRejection makes callers over the rate or concurrency limits be rejected with a ResourceExhausted status,
+// rather than delayed until they can proceed. Messages over the rate limits are dead-lettered if dead-lettering is
+// enabled (see WithDeadLetterOutput and WithDeadLetterWriter), the stream going on. Otherwise, the stream ends.
+func WithLimitRejection() InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.rejectOverLimit = true
+	}
+}
+
+// tokenBucket is a rate limiter that holds up to burst tokens, replenished at rate tokens per second.
+// A nil tokenBucket is unlimited.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64 // negative when tokens have been reserved ahead of time
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(1, math.Ceil(rate))
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes a token from the bucket, returning how long to wait before it is actually available. If wait is false
+// and no token is available right away, none is taken and false is returned.
+func (b *tokenBucket) reserve(wait bool) (time.Duration, bool) {
+	if b == nil {
+		return 0, true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if !wait {
+		return 0, false
+	}
+	b.tokens--
+	return time.Duration(-b.tokens / b.rate * float64(time.Second)), true
+}
+
+// refund gives back a token taken by reserve, that ended up unused
+func (b *tokenBucket) refund() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// semaphore bounds concurrency. A nil semaphore is unlimited.
+type semaphore chan struct{}
+
+func newSemaphore(size int) semaphore {
+	if size <= 0 {
+		return nil
+	}
+	return make(semaphore, size)
+}
+
+// tryAcquire acquires the semaphore if it is available right away, returning false otherwise
+func (s semaphore) tryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquire acquires the semaphore, waiting for it to become available unless done is closed first
+func (s semaphore) acquire(done <-chan struct{}) bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// admitStream acquires a stream slot for the invocation bound to ctx, or returns a ResourceExhausted error
+func (pi *pluginInvoker) admitStream(ctx context.Context) error {
+	if pi.rejectOverLimit && !pi.streams.tryAcquire() {
+		metrics.Add(concurrencyLimitedMetric, 1)
+		return invokerError{code: ConcurrencyLimitExceeded, message: "Too many concurrent streams"}
+	} else if !pi.rejectOverLimit && !pi.streams.acquire(ctx.Done()) {
+		return status.Error(codes.Canceled, ctx.Err().Error())
+	}
+	return nil
+}
+
+// admitInvocation acquires an in-flight invocation slot, or returns a ResourceExhausted error. When waiting for a slot,
+// a Canceled error is returned should done be closed first.
+func (pi *pluginInvoker) admitInvocation(done <-chan struct{}) error {
+	if pi.rejectOverLimit && !pi.inFlight.tryAcquire() {
+		metrics.Add(concurrencyLimitedMetric, 1)
+		return invokerError{code: ConcurrencyLimitExceeded, message: "Too many concurrent invocations"}
+	} else if !pi.rejectOverLimit && !pi.inFlight.acquire(done) {
+		return status.Error(codes.Canceled, "Stream ended while waiting for an invocation slot")
+	}
+	return nil
+}
+
+// throttle enforces the per stream and global rate limits, delaying the caller as needed, or returning a
+// ResourceExhausted error. A rejected message uses up none of the limits. Should cancellation happen while delaying,
+// a Canceled error is returned, so that the message is not processed.
+func (s *shared) throttle(pi *pluginInvoker) error {
+	buckets := []*tokenBucket{s.rateLimit, pi.globalBucket}
+	for i, bucket := range buckets {
+		delay, ok := bucket.reserve(!pi.rejectOverLimit)
+		if !ok {
+			for _, taken := range buckets[:i] {
+				taken.refund()
+			}
+			metrics.Add(rateLimitedMetric, 1)
+			return invokerError{code: RateLimitExceeded, message: "Rate limit exceeded"}
+		}
+		if delay > 0 {
+			Trace.Printf("[Sidecar -> Function] Rate limited, waiting %v\n", delay)
+			select {
+			case <-time.After(delay):
+			case <-s.done:
+				return status.Error(codes.Canceled, "Stream ended while rate limited")
+			}
+		}
+	}
+	return nil
+}
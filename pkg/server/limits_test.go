@@ -0,0 +1,129 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = Describe("Limits", func() {
+
+	Context("with a token bucket", func() {
+		It("should allow bursts of one second worth of tokens", func() {
+			bucket := newTokenBucket(10)
+			for i := 0; i < 10; i++ {
+				delay, ok := bucket.reserve(false)
+				Expect(ok).To(BeTrue())
+				Expect(delay).To(BeZero())
+			}
+			_, ok := bucket.reserve(false)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should tell how long to wait for reserved tokens", func() {
+			bucket := newTokenBucket(10)
+			bucket.tokens = 0
+			delay, ok := bucket.reserve(true)
+			Expect(ok).To(BeTrue())
+			Expect(delay).To(BeNumerically("~", 100*time.Millisecond, 10*time.Millisecond))
+			delay, ok = bucket.reserve(true)
+			Expect(ok).To(BeTrue())
+			Expect(delay).To(BeNumerically("~", 200*time.Millisecond, 10*time.Millisecond))
+		})
+
+		It("should take refunds of unused tokens, up to the burst size", func() {
+			bucket := newTokenBucket(1)
+			_, ok := bucket.reserve(false)
+			Expect(ok).To(BeTrue())
+			_, ok = bucket.reserve(false)
+			Expect(ok).To(BeFalse())
+			bucket.refund()
+			bucket.refund()
+			_, ok = bucket.reserve(false)
+			Expect(ok).To(BeTrue())
+			_, ok = bucket.reserve(false)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should be unlimited by default", func() {
+			bucket := newTokenBucket(0)
+			Expect(bucket).To(BeNil())
+			_, ok := bucket.reserve(false)
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Context("with a semaphore", func() {
+		It("should bound concurrency", func() {
+			s := newSemaphore(2)
+			Expect(s.tryAcquire()).To(BeTrue())
+			Expect(s.acquire(nil)).To(BeTrue())
+			Expect(s.tryAcquire()).To(BeFalse())
+
+			done := make(chan struct{})
+			close(done)
+			Expect(s.acquire(done)).To(BeFalse())
+
+			s.release()
+			Expect(s.tryAcquire()).To(BeTrue())
+		})
+
+		It("should be unlimited by default", func() {
+			s := newSemaphore(0)
+			Expect(s.tryAcquire()).To(BeTrue())
+			Expect(s.acquire(nil)).To(BeTrue())
+			s.release()
+		})
+	})
+
+	It("should not use up the per stream rate limit for messages rejected by the global one", func() {
+		pi := &pluginInvoker{globalBucket: newTokenBucket(1), rejectOverLimit: true}
+		s := &shared{rateLimit: newTokenBucket(1), done: make(chan struct{})}
+		pi.globalBucket.tokens = 0
+		Expect(s.throttle(pi)).To(MatchError(ContainSubstring("Rate limit exceeded")))
+		Expect(s.rateLimit.tokens).To(BeNumerically("~", 1, 0.01))
+	})
+
+	It("should stop delaying messages once the stream is over", func() {
+		pi := &pluginInvoker{globalBucket: newTokenBucket(0)}
+		s := &shared{rateLimit: newTokenBucket(1), done: make(chan struct{})}
+		s.rateLimit.tokens = -10
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			close(s.done)
+		}()
+		err := s.throttle(pi)
+		Expect(status.Code(err)).To(Equal(codes.Canceled))
+	})
+
+	It("should stop waiting for an invocation slot once the stream is over", func() {
+		pi := &pluginInvoker{inFlight: newSemaphore(1)}
+		Expect(pi.admitInvocation(nil)).To(Succeed())
+		done := make(chan struct{})
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			close(done)
+		}()
+		err := pi.admitInvocation(done)
+		Expect(status.Code(err)).To(Equal(codes.Canceled))
+	})
+})
@@ -21,9 +21,16 @@ import (
 	"reflect"
 	"mime"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"bytes"
+	"io/ioutil"
 	"strconv"
+	"encoding"
+	"time"
+	"errors"
+
+	"gopkg.in/yaml.v2"
 )
 
 type MediaType string
@@ -51,7 +58,32 @@ type Unmarshaller interface {
 }
 
 // jsonMarshalling supports both marshalling and unmarshalling to/from json according to golang's json rules.
+// Payloads are transcoded from/to UTF-8 according to the charset parameter of the media type, if any.
+// Notably, json.Marshaler and json.Unmarshaler (or their encoding.Text* counterparts) are honored, including
+// when implemented with a pointer receiver.
+// In strict mode, unknown fields and data trailing the json value are rejected when unmarshalling, see WithStrictJSON.
 type jsonMarshalling struct {
+	strict    bool // the default, which a 'strict' media type parameter overrides
+	useNumber bool // the default, which a 'usenumber' media type parameter overrides
+}
+
+const (
+	// Media type parameters that control json unmarshalling, as in "application/json; strict=true"
+	strictParam    = "strict"
+	useNumberParam = "usenumber"
+)
+
+// WithStrictJSON sets the default unmarshalling mode of json payloads: when strict, unknown fields and data trailing
+// the json value are errors, and when useNumber, numbers are decoded as json.Number (rather than float64) into
+// interface{} values. Both can be overridden for a given message with 'strict' and 'usenumber' media type parameters.
+func WithStrictJSON(strict bool, useNumber bool) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		for _, um := range invoker.unmarshallers {
+			if j, ok := um.(*jsonMarshalling); ok {
+				j.strict, j.useNumber = strict, useNumber
+			}
+		}
+	}
 }
 
 func (*jsonMarshalling) supportedMediaTypes(t reflect.Type) []MediaType {
@@ -60,37 +92,95 @@ func (*jsonMarshalling) supportedMediaTypes(t reflect.Type) []MediaType {
 }
 
 func (*jsonMarshalling) marshall(value interface{}, w io.Writer, mediaType MediaType) error {
-	err := json.NewEncoder(w).Encode(value)
-	return err
+	if value != nil && reflect.TypeOf(value).Kind() != reflect.Ptr {
+		// encoding/json only honors Marshaler (and TextMarshaler) methods with a pointer receiver on addressable values
+		value = addressable(value)
+	}
+	var buffer bytes.Buffer
+	err := json.NewEncoder(&buffer).Encode(value)
+	if err != nil {
+		return err
+	}
+	return writeEncoded(w, buffer.Bytes(), mediaType)
 }
 
+func (*jsonMarshalling) supportsCharset() {}
+
 func (*jsonMarshalling) canUnmarshall(t reflect.Type, mediaType MediaType) bool {
 	contentType, _, err := mime.ParseMediaType(string(mediaType))
 	if err != nil {
 		return false
 	}
 	// TODO should also chack that t is one of the supported types
-	return contentType == "application/json"
+	_, err = mediaTypeEncoding(mediaType)
+	return contentType == "application/json" && err == nil
 }
 
-func (*jsonMarshalling) unmarshall(r io.Reader, t reflect.Type, mediaType MediaType) (interface{}, error) {
+func (j *jsonMarshalling) unmarshall(r io.Reader, t reflect.Type, mediaType MediaType) (interface{}, error) {
+	r, err := decodingReader(r, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	_, params, _ := mime.ParseMediaType(string(mediaType))
+	strict, err := boolParam(params, strictParam, j.strict)
+	if err != nil {
+		return nil, err
+	}
+	useNumber, err := boolParam(params, useNumberParam, j.useNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(r)
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	if useNumber {
+		decoder.UseNumber()
+	}
 	ptrToData := reflect.New(t)
-	err := json.NewDecoder(r).Decode(ptrToData.Interface())
+	err = decoder.Decode(ptrToData.Interface())
 	if err != nil {
 		return nil, err
 	}
+	if strict {
+		if _, err := decoder.Token(); err != io.EOF {
+			return nil, errors.New("invalid data after top-level json value")
+		}
+	}
 	return reflect.Indirect(ptrToData).Interface(), nil
 }
 
-// textMarshalling supports marshalling from golang's fmt.Stringer type and unmarshalling to golang's string
+// boolParam returns the boolean value of the given media type parameter, or def if absent
+func boolParam(params map[string]string, name string, def bool) (bool, error) {
+	v, ok := params[name]
+	if !ok {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %v parameter: %v", name, v)
+	}
+	return b, nil
+}
+
+// textMarshalling supports marshalling to and unmarshalling from plain text. Supported types are all the basic kinds
+// (strings, booleans and numbers) as well as types implementing encoding.TextMarshaler (for output) and
+// encoding.TextUnmarshaler (for input), which take precedence. For output, fmt.Stringer is also supported.
+// Methods with a pointer receiver are honored, and time.Duration is parsed back according to time.ParseDuration.
+// Text is transcoded from/to UTF-8 according to the charset parameter of the media type, if any.
 type textMarshalling struct {
 }
 
+var (
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	stringerType        = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+	durationType        = reflect.TypeOf(time.Duration(0))
+)
+
 func (*textMarshalling) supportedMediaTypes(t reflect.Type) []MediaType {
-	var pstringer *fmt.Stringer
-	stringerType := reflect.TypeOf(pstringer).Elem()
-	if t.AssignableTo(stringerType) || t.Kind() == reflect.String || t.Kind() == reflect.Int || t.Kind() == reflect.Float32 ||
-		t.Kind() == reflect.Float64 {
+	if t != nil && (implements(t, textMarshalerType) || implements(t, stringerType) || isBasicKind(t.Kind())) {
 		return []MediaType{"text/plain"}
 	} else {
 		return nil
@@ -100,50 +190,257 @@ func (*textMarshalling) supportedMediaTypes(t reflect.Type) []MediaType {
 // X -> string
 func (*textMarshalling) marshall(value interface{}, w io.Writer, mediaType MediaType) error {
 	var s string
-	switch v := value.(type) {
-	case int:
-		s = strconv.Itoa(v)
-	case float32:
-		s = strconv.FormatFloat(float64(v), 'f', -1, 32)
-	case float64:
-		s = strconv.FormatFloat(v, 'f', -1, 64)
-	case string:
-		s = v
-	case fmt.Stringer:
-		s = v.String()
-	}
-	_, error := io.WriteString(w, s)
-	return error
+	if m, ok := withMethods(value, textMarshalerType).(encoding.TextMarshaler); ok {
+		b, err := m.MarshalText()
+		if err != nil {
+			return err
+		}
+		s = string(b)
+	} else if stringer, ok := withMethods(value, stringerType).(fmt.Stringer); ok {
+		s = stringer.String()
+	} else {
+		v := reflect.ValueOf(value)
+		switch v.Kind() {
+		case reflect.String:
+			s = v.String()
+		case reflect.Bool:
+			s = strconv.FormatBool(v.Bool())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			s = strconv.FormatInt(v.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			s = strconv.FormatUint(v.Uint(), 10)
+		case reflect.Float32, reflect.Float64:
+			s = strconv.FormatFloat(v.Float(), 'f', -1, v.Type().Bits())
+		case reflect.Complex64, reflect.Complex128:
+			s = fmt.Sprint(value)
+		default:
+			return fmt.Errorf("unsupported type %T", value)
+		}
+	}
+	return writeEncoded(w, []byte(s), mediaType)
 }
 
+func (*textMarshalling) supportsCharset() {}
+
 func (*textMarshalling) canUnmarshall(t reflect.Type, mediaType MediaType) bool {
 	contentType, _, err := mime.ParseMediaType(string(mediaType))
 	if err != nil {
 		return false
 	}
+	if _, err := mediaTypeEncoding(mediaType); err != nil {
+		return false
+	}
 	return contentType == "text/plain" &&
-		(t.Kind() == reflect.String || t.Kind() == reflect.Int || t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64)
+		(reflect.PtrTo(t).Implements(textUnmarshalerType) || t.Implements(textUnmarshalerType) && t.Kind() == reflect.Ptr ||
+			isBasicKind(t.Kind()))
 }
 
 // string -> X
 func (*textMarshalling) unmarshall(r io.Reader, t reflect.Type, mediaType MediaType) (interface{}, error) {
+	r, err := decodingReader(r, mediaType)
+	if err != nil {
+		return nil, err
+	}
 	buf := new(bytes.Buffer)
-	_, err := buf.ReadFrom(r)
+	_, err = buf.ReadFrom(r)
 	if err != nil {
 		return nil, err
 	}
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		ptrToData := reflect.New(t)
+		err := ptrToData.Interface().(encoding.TextUnmarshaler).UnmarshalText(buf.Bytes())
+		return ptrToData.Elem().Interface(), err
+	} else if t.Kind() == reflect.Ptr && t.Implements(textUnmarshalerType) {
+		ptrToData := reflect.New(t.Elem())
+		err := ptrToData.Interface().(encoding.TextUnmarshaler).UnmarshalText(buf.Bytes())
+		return ptrToData.Interface(), err
+	}
+
+	result := reflect.New(t).Elem()
 	switch t.Kind() {
 	case reflect.String:
-		return buf.String(), err
-	case reflect.Int:
-		return strconv.Atoi(buf.String())
-	case reflect.Float32:
-		f, err := strconv.ParseFloat(buf.String(), 32)
-		return float32(f), err
-	case reflect.Float64:
-		return strconv.ParseFloat(buf.String(), 64)
+		result.SetString(buf.String())
+	case reflect.Bool:
+		b, err := strconv.ParseBool(buf.String())
+		if err != nil {
+			return nil, err
+		}
+		result.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if t == durationType {
+			var d time.Duration
+			d, err = time.ParseDuration(buf.String())
+			i = int64(d)
+		} else if t.Kind() == reflect.Int {
+			var n int
+			n, err = strconv.Atoi(buf.String())
+			i = int64(n)
+		} else {
+			i, err = strconv.ParseInt(buf.String(), 10, t.Bits())
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := strconv.ParseUint(buf.String(), 10, t.Bits())
+		if err != nil {
+			return nil, err
+		}
+		result.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(buf.String(), t.Bits())
+		if err != nil {
+			return nil, err
+		}
+		result.SetFloat(f)
+	case reflect.Complex64, reflect.Complex128:
+		var c complex128
+		if _, err := fmt.Sscan(buf.String(), &c); err != nil {
+			return nil, err
+		}
+		result.SetComplex(c)
 	default:
 		panic("Unreachable thanks to canUnmarshall()")
+	}
+	return result.Interface(), nil
+}
+
+// isBasicKind returns true for strings, booleans and numbers
+func isBasicKind(k reflect.Kind) bool {
+	return k == reflect.String || k == reflect.Bool || reflect.Int <= k && k <= reflect.Complex128
+}
 
+// implements returns true if either t or *t implements the given interface type
+func implements(t reflect.Type, iface reflect.Type) bool {
+	return t.Implements(iface) || reflect.PtrTo(t).Implements(iface)
+}
+
+// withMethods returns value itself if its type implements the given interface type, or a pointer to a copy of value if
+// only the pointer type does (that is, for methods with a pointer receiver). Otherwise, value is returned as is.
+func withMethods(value interface{}, iface reflect.Type) interface{} {
+	t := reflect.TypeOf(value)
+	if t == nil || t.Implements(iface) || !reflect.PtrTo(t).Implements(iface) {
+		return value
 	}
+	return addressable(value)
+}
+
+// addressable returns a pointer to a copy of value, so that methods with a pointer receiver can be invoked on it
+func addressable(value interface{}) interface{} {
+	ptr := reflect.New(reflect.TypeOf(value))
+	ptr.Elem().Set(reflect.ValueOf(value))
+	return ptr.Interface()
+}
+
+// xmlMarshalling supports both marshalling and unmarshalling to/from xml according to golang's encoding/xml rules.
+// Notably, struct fields are mapped according to their `xml` struct tags (defaulting to the field name) and the root
+// element is named after the type (or an XMLName field). Channels, funcs and maps are not supported, and
+// result in an error.
+type xmlMarshalling struct {
+}
+
+func (*xmlMarshalling) supportedMediaTypes(t reflect.Type) []MediaType {
+	return []MediaType{"application/xml", "text/xml"}
+}
+
+func (*xmlMarshalling) marshall(value interface{}, w io.Writer, mediaType MediaType) error {
+	return xml.NewEncoder(w).Encode(value)
+}
+
+func (*xmlMarshalling) canUnmarshall(t reflect.Type, mediaType MediaType) bool {
+	contentType, _, err := mime.ParseMediaType(string(mediaType))
+	if err != nil {
+		return false
+	}
+	return contentType == "application/xml" || contentType == "text/xml"
+}
+
+func (*xmlMarshalling) unmarshall(r io.Reader, t reflect.Type, mediaType MediaType) (interface{}, error) {
+	ptrToData := reflect.New(t)
+	err := xml.NewDecoder(r).Decode(ptrToData.Interface())
+	if err != nil {
+		return nil, err
+	}
+	return reflect.Indirect(ptrToData).Interface(), nil
+}
+
+// yamlMarshalling supports both marshalling and unmarshalling to/from yaml according to gopkg.in/yaml.v2 rules.
+// Notably, struct fields are mapped according to their `yaml` struct tags (not `json` ones), defaulting to the
+// lowercased field name, and generic maps are decoded as map[interface{}]interface{}. Channels and funcs are not
+// supported, and result in an error.
+type yamlMarshalling struct {
+}
+
+func (*yamlMarshalling) supportedMediaTypes(t reflect.Type) []MediaType {
+	return []MediaType{"application/x-yaml", "application/yaml", "text/yaml"}
+}
+
+func (*yamlMarshalling) marshall(value interface{}, w io.Writer, mediaType MediaType) (err error) {
+	defer recoverAsError(&err) // yaml.v2 panics on unsupported types
+	b, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (*yamlMarshalling) canUnmarshall(t reflect.Type, mediaType MediaType) bool {
+	contentType, _, err := mime.ParseMediaType(string(mediaType))
+	if err != nil {
+		return false
+	}
+	return contentType == "application/x-yaml" || contentType == "application/yaml" || contentType == "text/yaml"
+}
+
+func (*yamlMarshalling) unmarshall(r io.Reader, t reflect.Type, mediaType MediaType) (result interface{}, err error) {
+	defer recoverAsError(&err)
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	ptrToData := reflect.New(t)
+	err = yaml.Unmarshal(b, ptrToData.Interface())
+	if err != nil {
+		return nil, err
+	}
+	return reflect.Indirect(ptrToData).Interface(), nil
+}
+
+// recoverAsError is meant to be deferred, and turns a panic into an error assigned to err
+func recoverAsError(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("%v", r)
+	}
+}
+
+// toGeneric turns value into its generic representation according to golang's json rules (hence honoring `json` struct
+// tags), made of map[string]interface{}, []interface{}, string, json.Number, bool and nil values.
+func toGeneric(value interface{}) (interface{}, error) {
+	var buffer bytes.Buffer
+	if err := (&jsonMarshalling{}).marshall(value, &buffer, "application/json"); err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(&buffer)
+	decoder.UseNumber()
+	var generic interface{}
+	err := decoder.Decode(&generic)
+	return generic, err
+}
+
+// fromGeneric is the converse of toGeneric, turning a generic representation into an instance of t
+func fromGeneric(generic interface{}, t reflect.Type) (interface{}, error) {
+	b, err := json.Marshal(generic)
+	if err != nil {
+		return nil, err
+	}
+	return (&jsonMarshalling{}).unmarshall(bytes.NewReader(b), t, "application/json")
+}
+
+// parseUint returns the value of n if it is an integer that only fits in an uint64
+func parseUint(n json.Number) (uint64, bool) {
+	u, err := strconv.ParseUint(string(n), 10, 64)
+	return u, err == nil
 }
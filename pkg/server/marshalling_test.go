@@ -0,0 +1,378 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/projectriff/go-function-invoker/pkg/function"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// celsius implements its Marshaler and Unmarshaler methods with a pointer receiver
+type celsius float64
+
+func (c *celsius) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%v°C"`, float64(*c))), nil
+}
+
+func (c *celsius) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%v degrees", float64(*c))), nil
+}
+
+func (c *celsius) UnmarshalText(text []byte) error {
+	_, err := fmt.Sscanf(string(text), "%g degrees", (*float64)(c))
+	return err
+}
+
+type word struct {
+	Word  string `json:"word"`
+	Count int    `json:"count,omitempty"`
+	Tags  []string
+	Raw   []byte
+}
+
+var _ = Describe("Marshalling", func() {
+
+	roundTrip := func(m Marshaller, u Unmarshaller, mediaType MediaType, value interface{}) interface{} {
+		var buffer bytes.Buffer
+		Expect(m.marshall(value, &buffer, mediaType)).To(Succeed())
+		Expect(u.canUnmarshall(reflect.TypeOf(value), mediaType)).To(BeTrue())
+		result, err := u.unmarshall(&buffer, reflect.TypeOf(value), mediaType)
+		Expect(err).NotTo(HaveOccurred())
+		return result
+	}
+
+	Context("with text", func() {
+		t := &textMarshalling{}
+
+		It("should round trip all basic kinds", func() {
+			type level uint8
+			for _, value := range []interface{}{"a", true, -3, int8(-8), int64(1) << 40, uint(7), level(2), float32(0.5),
+				1.25, complex(1, -2), 2 * time.Hour} {
+				Expect(t.supportedMediaTypes(reflect.TypeOf(value))).To(Equal([]MediaType{"text/plain"}))
+				Expect(roundTrip(t, t, "text/plain", value)).To(Equal(value))
+			}
+		})
+
+		It("should honor TextMarshaler and TextUnmarshaler", func() {
+			when := time.Date(2018, time.March, 7, 20, 58, 19, 0, time.UTC)
+			Expect(roundTrip(t, t, "text/plain", when)).To(Equal(when))
+			Expect(roundTrip(t, t, "text/plain", celsius(21.5))).To(Equal(celsius(21.5)))
+			Expect(roundTrip(t, t, "text/plain", &when)).To(Equal(&when))
+
+			var buffer bytes.Buffer
+			Expect(t.marshall(celsius(-4), &buffer, "text/plain")).To(Succeed())
+			Expect(buffer.String()).To(Equal("-4 degrees"))
+		})
+
+		It("should reject other types", func() {
+			Expect(t.supportedMediaTypes(reflect.TypeOf(word{}))).To(BeEmpty())
+			Expect(t.canUnmarshall(reflect.TypeOf([]int{}), "text/plain")).To(BeFalse())
+			_, err := t.unmarshall(bytes.NewBufferString("maybe"), reflect.TypeOf(true), "text/plain")
+			Expect(err).To(MatchError(ContainSubstring("invalid syntax")))
+		})
+	})
+
+	Context("with json", func() {
+		j := &jsonMarshalling{}
+
+		It("should honor Marshaler methods with a pointer receiver", func() {
+			var buffer bytes.Buffer
+			Expect(j.marshall(celsius(21.5), &buffer, "application/json")).To(Succeed())
+			Expect(buffer.String()).To(Equal(`"21.5°C"` + "\n"))
+
+			buffer.Reset()
+			Expect(j.marshall(struct{ C celsius }{3}, &buffer, "application/json")).To(Succeed())
+			Expect(buffer.String()).To(Equal(`{"C":"3°C"}` + "\n"))
+		})
+
+		It("should be lenient by default", func() {
+			result, err := j.unmarshall(bytes.NewBufferString(`{"word": "a", "typo": 1} trailing`), reflect.TypeOf(word{}), "application/json")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(word{Word: "a"}))
+		})
+
+		It("should reject unknown fields and trailing data in strict mode", func() {
+			strict := &jsonMarshalling{strict: true}
+			_, err := strict.unmarshall(bytes.NewBufferString(`{"word": "a", "typo": 1}`), reflect.TypeOf(word{}), "application/json")
+			Expect(err).To(MatchError(ContainSubstring(`unknown field "typo"`)))
+			_, err = strict.unmarshall(bytes.NewBufferString(`{"word": "a"} {}`), reflect.TypeOf(word{}), "application/json")
+			Expect(err).To(MatchError("invalid data after top-level json value"))
+			_, err = strict.unmarshall(bytes.NewBufferString(`{"word": "a"} }`), reflect.TypeOf(word{}), "application/json")
+			Expect(err).To(HaveOccurred())
+			result, err := strict.unmarshall(bytes.NewBufferString(`{"word": "a"}`+"\n"), reflect.TypeOf(word{}), "application/json")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(word{Word: "a"}))
+		})
+
+		It("should honor media type parameters", func() {
+			_, err := j.unmarshall(bytes.NewBufferString(`{"typo": 1}`), reflect.TypeOf(word{}), "application/json; strict=true")
+			Expect(err).To(MatchError(ContainSubstring(`unknown field "typo"`)))
+			_, err = (&jsonMarshalling{strict: true}).unmarshall(bytes.NewBufferString(`{"typo": 1}`), reflect.TypeOf(word{}), "application/json; strict=false")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = j.unmarshall(bytes.NewBufferString(`{}`), reflect.TypeOf(word{}), "application/json; strict=sometimes")
+			Expect(err).To(MatchError("invalid strict parameter: sometimes"))
+
+			var generic interface{}
+			result, err := j.unmarshall(bytes.NewBufferString(`12345678901234567890`), reflect.TypeOf(&generic).Elem(), "application/json; usenumber=true")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(json.Number("12345678901234567890")))
+		})
+	})
+
+	Context("with charsets", func() {
+		It("should decode and encode text", func() {
+			t := &textMarshalling{}
+			result, err := t.unmarshall(bytes.NewBufferString("\xa4 \xe9"), reflect.TypeOf(""), "text/plain; charset=iso-8859-15")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal("\u20ac \u00e9"))
+
+			var buffer bytes.Buffer
+			Expect(t.marshall("\u00e9t\u00e9", &buffer, "text/plain; charset=windows-1252")).To(Succeed())
+			Expect(buffer.String()).To(Equal("\xe9t\xe9"))
+			Expect(t.marshall("\u20ac", &buffer, "text/plain; charset=iso-8859-1")).NotTo(Succeed())
+		})
+
+		It("should decode json", func() {
+			j := &jsonMarshalling{}
+			Expect(j.canUnmarshall(reflect.TypeOf(word{}), "application/json; charset=utf-16le")).To(BeTrue())
+			Expect(j.canUnmarshall(reflect.TypeOf(word{}), "application/json; charset=klingon")).To(BeFalse())
+			in := []byte{'{', 0, '"', 0, 'w', 0, 'o', 0, 'r', 0, 'd', 0, '"', 0, ':', 0, '"', 0, 0xe9, 0, '"', 0, '}', 0}
+			result, err := j.unmarshall(bytes.NewReader(in), reflect.TypeOf(word{}), "application/json; charset=utf-16le")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(word{Word: "\u00e9"}))
+		})
+
+		It("should negotiate charsets", func() {
+			Expect(negotiateCharset([]string{"*/*; charset=utf-16, text/*; charset=latin1"}, "text/plain")).To(Equal("latin1"))
+			Expect(negotiateCharset([]string{"text/plain"}, "text/plain")).To(Equal(""))
+			Expect(withAcceptCharset(nil, []string{"klingon, iso-8859-1;q=0.8"})).To(Equal([]string{"text/plain; charset=iso-8859-1"}))
+			Expect(withAcceptCharset([]string{"text/plain"}, nil)).To(Equal([]string{"text/plain"}))
+		})
+	})
+
+	Context("with xml", func() {
+		x := &xmlMarshalling{}
+
+		It("should round trip values", func() {
+			value := word{Word: "riff", Count: 2, Tags: []string{"a", "b"}, Raw: []byte("raw")}
+			Expect(roundTrip(x, x, "application/xml", value)).To(Equal(value))
+			Expect(roundTrip(x, x, "text/xml", "hello")).To(Equal("hello"))
+		})
+
+		It("should report unsupported types", func() {
+			var buffer bytes.Buffer
+			Expect(x.marshall(make(chan int), &buffer, "application/xml")).To(MatchError(ContainSubstring("unsupported type")))
+			Expect(x.marshall(map[string]int{}, &buffer, "application/xml")).To(MatchError(ContainSubstring("unsupported type")))
+		})
+	})
+
+	Context("with yaml", func() {
+		y := &yamlMarshalling{}
+
+		It("should round trip values", func() {
+			value := word{Word: "riff", Count: 2, Tags: []string{"a", "b"}, Raw: []byte{1}}
+			Expect(roundTrip(y, y, "application/x-yaml", value)).To(Equal(value))
+			Expect(roundTrip(y, y, "text/yaml", 3.5)).To(Equal(3.5))
+		})
+
+		It("should honor yaml struct tags", func() {
+			type tagged struct {
+				Word string `yaml:"w"`
+			}
+			var buffer bytes.Buffer
+			Expect(y.marshall(tagged{Word: "riff"}, &buffer, "application/yaml")).To(Succeed())
+			Expect(buffer.String()).To(Equal("w: riff\n"))
+		})
+
+		It("should report unsupported types rather than panic", func() {
+			var buffer bytes.Buffer
+			Expect(y.marshall(make(chan int), &buffer, "application/x-yaml")).To(MatchError(ContainSubstring("cannot marshal type")))
+			Expect(y.marshall(func() {}, &buffer, "application/x-yaml")).To(MatchError(ContainSubstring("cannot marshal type")))
+		})
+	})
+
+	Context("with msgpack", func() {
+		m := &msgpackMarshalling{}
+
+		It("should honor json struct tags", func() {
+			var buffer bytes.Buffer
+			Expect(m.marshall(word{Word: "a", Count: 1}, &buffer, "application/msgpack")).To(Succeed())
+			Expect(buffer.Bytes()).To(Equal(append([]byte{0x84, 0xa3}, "Raw\xc0\xa4Tags\xc0\xa5count\x01\xa4word\xa1a"...)))
+		})
+
+		It("should round trip values", func() {
+			value := word{Word: "riff", Count: -100000, Tags: []string{"a", string(make([]byte, 300))}, Raw: []byte{1, 2, 3}}
+			Expect(roundTrip(m, m, "application/msgpack", value)).To(Equal(value))
+			Expect(roundTrip(m, m, "application/x-msgpack", 3.14)).To(Equal(3.14))
+			Expect(roundTrip(m, m, "application/msgpack", uint64(1<<63))).To(Equal(uint64(1 << 63)))
+		})
+
+		It("should report unsupported types", func() {
+			var buffer bytes.Buffer
+			Expect(m.marshall(make(chan int), &buffer, "application/msgpack")).NotTo(Succeed())
+		})
+
+		It("should reject hostile length prefixes", func() {
+			for name, in := range map[string][]byte{
+				"str 32":   []byte{0xdb, 0x7f, 0xff, 0xff, 0xff},
+				"bin 32":   []byte{0xc6, 0x7f, 0xff, 0xff, 0xff},
+				"array 32": []byte{0xdd, 0x7f, 0xff, 0xff, 0xff},
+				"map 32":   []byte{0xdf, 0x7f, 0xff, 0xff, 0xff},
+				"fixarray": []byte{0x9f, 0x01},
+			} {
+				_, err := m.unmarshall(bytes.NewReader(in), reflect.TypeOf(map[string]interface{}{}), "application/msgpack")
+				Expect(err).To(MatchError(ContainSubstring("exceeds the")), name)
+			}
+		})
+
+		It("should reject deeply nested values", func() {
+			in := bytes.Repeat([]byte{0x91}, 10000)
+			_, err := m.unmarshall(bytes.NewReader(in), reflect.TypeOf([]interface{}{}), "application/msgpack")
+			Expect(err).To(MatchError("values nested more than 512 levels deep"))
+		})
+	})
+
+	Context("with cbor", func() {
+		c := &cborMarshalling{}
+
+		It("should honor json struct tags", func() {
+			var buffer bytes.Buffer
+			Expect(c.marshall(word{Word: "a", Count: 1}, &buffer, "application/cbor")).To(Succeed())
+			Expect(buffer.Bytes()).To(Equal(append([]byte{0xa4, 0x63}, "Raw\xf6\x64Tags\xf6\x65count\x01\x64word\x61a"...)))
+		})
+
+		It("should round trip values", func() {
+			value := word{Word: "riff", Count: -100000, Tags: []string{"a", string(make([]byte, 300))}, Raw: []byte{1, 2, 3}}
+			Expect(roundTrip(c, c, "application/cbor", value)).To(Equal(value))
+			Expect(roundTrip(c, c, "application/cbor", 3.14)).To(Equal(3.14))
+		})
+
+		It("should decode indefinite lengths and half floats", func() {
+			// {_ "word": (_ "ri", "ff"), "count": 1.5 (half float)}
+			in := []byte{0xbf, 0x64, 'w', 'o', 'r', 'd', 0x7f, 0x62, 'r', 'i', 0x62, 'f', 'f', 0xff, 0x65, 'c', 'o', 'u', 'n', 't', 0xf9, 0x3e, 0x00, 0xff}
+			result, err := c.unmarshall(bytes.NewReader(in), reflect.TypeOf(map[string]interface{}{}), "application/cbor")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(map[string]interface{}{"word": "riff", "count": 1.5}))
+		})
+
+		It("should reject hostile length prefixes", func() {
+			for name, in := range map[string][]byte{
+				"text string":             []byte{0x7b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+				"byte string":             []byte{0x5a, 0xff, 0xff, 0xff, 0xff},
+				"indefinite string chunk": []byte{0x7f, 0x7a, 0xff, 0xff, 0xff, 0xff},
+				"array":                   []byte{0x9a, 0xff, 0xff, 0xff, 0xff},
+				"map":                     []byte{0xba, 0xff, 0xff, 0xff, 0xff},
+			} {
+				_, err := c.unmarshall(bytes.NewReader(in), reflect.TypeOf(map[string]interface{}{}), "application/cbor")
+				Expect(err).To(MatchError(ContainSubstring("exceeds the")), name)
+			}
+		})
+
+		It("should reject deeply nested values", func() {
+			in := bytes.Repeat([]byte{0x81}, 10000)
+			_, err := c.unmarshall(bytes.NewReader(in), reflect.TypeOf([]interface{}{}), "application/cbor")
+			Expect(err).To(MatchError("values nested more than 512 levels deep"))
+			in = bytes.Repeat([]byte{0xc1}, 10000) // tags
+			_, err = c.unmarshall(bytes.NewReader(in), reflect.TypeOf([]interface{}{}), "application/cbor")
+			Expect(err).To(MatchError("values nested more than 512 levels deep"))
+		})
+	})
+
+	Context("with protobuf", func() {
+		p := &protobufMarshalling{}
+
+		It("should only support generated messages", func() {
+			Expect(p.supportedMediaTypes(reflect.TypeOf(&function.Message{}))).To(Equal([]MediaType{"application/x-protobuf", "application/protobuf"}))
+			Expect(p.supportedMediaTypes(reflect.TypeOf(word{}))).To(BeEmpty())
+			Expect(p.canUnmarshall(reflect.TypeOf(word{}), "application/x-protobuf")).To(BeFalse())
+		})
+
+		It("should round trip messages", func() {
+			value := &function.Message{Payload: []byte("riff"),
+				Headers: map[string]*function.Message_HeaderValue{"Foo": {Values: []string{"bar"}}}}
+			Expect(roundTrip(p, p, "application/x-protobuf", value)).To(Equal(value))
+			Expect(roundTrip(p, p, "application/protobuf", *value)).To(Equal(*value))
+		})
+	})
+
+	Context("with structured syntax suffixes", func() {
+		It("should resolve suffixes to the media type they stand for", func() {
+			Expect(suffixBase("application/vnd.acme.order+json")).To(Equal(MediaType("application/json")))
+			Expect(suffixBase("application/merge-patch+json; charset=utf-8")).To(Equal(MediaType("application/json; charset=utf-8")))
+			Expect(suffixBase("application/atom+xml")).To(Equal(MediaType("application/xml")))
+			Expect(suffixBase("application/vnd.acme.order+proto")).To(Equal(MediaType("application/x-protobuf")))
+			Expect(suffixBase("application/json")).To(BeEmpty())
+			Expect(suffixBase("application/vnd.acme+zip")).To(BeEmpty())
+		})
+
+		It("should offer vendor types that are asked for", func() {
+			marshallers := map[MediaType]Marshaller{"application/json": &jsonMarshalling{}, "text/plain": &textMarshalling{}}
+			offers := withSuffixOffers([]string{"application/vnd.acme+json;q=0.5, text/vnd.acme+json, text/plain"},
+				[]MediaType{"application/json", "text/plain"}, marshallers)
+			Expect(offers).To(Equal([]MediaType{"application/vnd.acme+json", "text/vnd.acme+json", "application/json", "text/plain"}))
+			Expect(marshallers["application/vnd.acme+json"]).To(Equal(marshallers["application/json"]))
+		})
+	})
+
+	Context("with records", func() {
+		type item struct {
+			Name     string
+			Quantity int    `csv:"qty"`
+			Note     string `csv:"-"`
+		}
+
+		It("should expand ndjson lines", func() {
+			n := &ndjsonMarshalling{}
+			result, err := n.unmarshall(bytes.NewBufferString("{\"word\":\"a\"}\n\n{\"word\":\"b\"}\n"), reflect.TypeOf(word{}), NDJSONContentType)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(records{word{Word: "a"}, word{Word: "b"}}))
+
+			_, err = n.unmarshall(bytes.NewBufferString("{\"word\":\"a\"}\n{\"word\":"), reflect.TypeOf(word{}), NDJSONContentType)
+			Expect(err).To(MatchError(ContainSubstring("record #1")))
+		})
+
+		It("should aggregate slices as ndjson", func() {
+			var buffer bytes.Buffer
+			Expect((&ndjsonMarshalling{}).marshall([]int{1, 2}, &buffer, NDJSONContentType)).To(Succeed())
+			Expect(buffer.String()).To(Equal("1\n2\n"))
+		})
+
+		It("should map csv columns onto struct fields by header", func() {
+			c := &csvMarshalling{}
+			Expect(c.canUnmarshall(reflect.TypeOf(item{}), "text/csv; header=present")).To(BeTrue())
+			result, err := c.unmarshall(bytes.NewBufferString("qty,Name,Note\n2,apple,ignored\n"), reflect.TypeOf(item{}), CSVContentType)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(records{item{Name: "apple", Quantity: 2}}))
+		})
+
+		It("should expand csv rows as string slices", func() {
+			result, err := (&csvMarshalling{}).unmarshall(bytes.NewBufferString("a,b\n\"c,d\",e\n"), reflect.TypeOf([]string{}), CSVContentType)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(records{[]string{"a", "b"}, []string{"c,d", "e"}}))
+		})
+
+		It("should cope with nil values", func() {
+			var buffer bytes.Buffer
+			Expect((&ndjsonMarshalling{}).marshall(nil, &buffer, NDJSONContentType)).To(Succeed())
+			Expect(buffer.String()).To(Equal("null\n"))
+			Expect((&csvMarshalling{}).supportedMediaTypes(nil)).To(BeEmpty())
+			Expect((&csvMarshalling{}).marshall(nil, &buffer, CSVContentType)).To(MatchError("cannot marshall nil as CSV"))
+		})
+
+		It("should aggregate slices as csv", func() {
+			c := &csvMarshalling{}
+			var buffer bytes.Buffer
+			Expect(c.marshall([]item{{"apple", 2, "x"}, {"pear", 1, ""}}, &buffer, CSVContentType)).To(Succeed())
+			Expect(buffer.String()).To(Equal("Name,qty\napple,2\npear,1\n"))
+
+			Expect(c.supportedMediaTypes(reflect.TypeOf(3))).To(BeEmpty())
+			Expect(c.supportedMediaTypes(reflect.TypeOf([][]string{}))).To(Equal([]MediaType{CSVContentType}))
+		})
+	})
+})
@@ -0,0 +1,37 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import "expvar"
+
+// MetricsName is the name under which the invoker metrics are published, see package expvar
+const MetricsName = "invoker"
+
+const (
+	retriesMetric          = "retries"           // function invocations that were attempted again
+	retriesExhaustedMetric = "retries_exhausted" // function errors that persisted after all attempts
+	permanentErrorsMetric  = "permanent_errors"  // function errors marked as not retryable
+
+	rateLimitedMetric        = "rate_limited"        // messages rejected for exceeding a rate limit
+	concurrencyLimitedMetric = "concurrency_limited" // streams or invocations rejected for exceeding a concurrency limit
+
+	leakedFunctionsMetric = "leaked_functions" // functions abandoned for not closing their outputs, see WithLeakGracePeriod
+)
+
+// metrics holds the invoker counters. Being published with expvar, they are served as json (along with runtime
+// memory statistics) by any HTTP server using http.DefaultServeMux, at /debug/vars.
+var metrics = expvar.NewMap(MetricsName)
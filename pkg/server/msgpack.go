@@ -0,0 +1,347 @@
+/*
+ * Copyright 2018-Present the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"reflect"
+	"sort"
+)
+
+// maxNestingDepth bounds the nesting of arrays and maps (and CBOR tags) when decoding MessagePack and CBOR
+const maxNestingDepth = 512
+
+// msgpackMarshalling supports both marshalling and unmarshalling to/from MessagePack. Values are converted to/from
+// their generic json representation (see toGeneric), hence follow golang's json rules and honor `json` struct tags.
+// MessagePack bin values are decoded as base64 strings, so that they can populate []byte fields.
+type msgpackMarshalling struct {
+}
+
+func (*msgpackMarshalling) supportedMediaTypes(t reflect.Type) []MediaType {
+	return []MediaType{"application/msgpack", "application/x-msgpack"}
+}
+
+func (*msgpackMarshalling) marshall(value interface{}, w io.Writer, mediaType MediaType) error {
+	generic, err := toGeneric(value)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if err := writeMsgpack(bw, generic); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (*msgpackMarshalling) canUnmarshall(t reflect.Type, mediaType MediaType) bool {
+	contentType, _, err := mime.ParseMediaType(string(mediaType))
+	if err != nil {
+		return false
+	}
+	return contentType == "application/msgpack" || contentType == "application/x-msgpack"
+}
+
+func (*msgpackMarshalling) unmarshall(r io.Reader, t reflect.Type, mediaType MediaType) (interface{}, error) {
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	generic, err := readMsgpack(bytes.NewReader(payload), 0)
+	if err != nil {
+		return nil, err
+	}
+	return fromGeneric(generic, t)
+}
+
+func writeMsgpack(w *bufio.Writer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		return w.WriteByte(0xc0)
+	case bool:
+		if v {
+			return w.WriteByte(0xc3)
+		}
+		return w.WriteByte(0xc2)
+	case json.Number:
+		return writeMsgpackNumber(w, v)
+	case string:
+		writeMsgpackHeader(w, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		_, err := w.WriteString(v)
+		return err
+	case []interface{}:
+		writeMsgpackHeader(w, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			if err := writeMsgpack(w, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		writeMsgpackHeader(w, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range sortedKeys(v) {
+			if err := writeMsgpack(w, k); err != nil {
+				return err
+			}
+			if err := writeMsgpack(w, v[k]); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported type for msgpack: %T", value)
+	}
+}
+
+// writeMsgpackHeader writes the header of a string, array or map of the given length, using the fix variant (whose
+// lengths are below fixLimit) or the 8 (if non zero), 16 and 32 bits variants.
+func writeMsgpackHeader(w *bufio.Writer, length int, fix byte, fixLimit int, code8 byte, code16 byte, code32 byte) {
+	switch {
+	case length < fixLimit:
+		w.WriteByte(fix | byte(length))
+	case code8 != 0 && length <= math.MaxUint8:
+		w.Write([]byte{code8, byte(length)})
+	case length <= math.MaxUint16:
+		w.WriteByte(code16)
+		binary.Write(w, binary.BigEndian, uint16(length))
+	default:
+		w.WriteByte(code32)
+		binary.Write(w, binary.BigEndian, uint32(length))
+	}
+}
+
+func writeMsgpackNumber(w *bufio.Writer, n json.Number) error {
+	if i, err := n.Int64(); err == nil {
+		switch {
+		case i >= 0 && i <= math.MaxInt8:
+			return w.WriteByte(byte(i))
+		case i < 0 && i >= -32:
+			return w.WriteByte(byte(int8(i)))
+		case i >= math.MinInt8 && i <= math.MaxInt8:
+			w.WriteByte(0xd0)
+			return binary.Write(w, binary.BigEndian, int8(i))
+		case i >= math.MinInt16 && i <= math.MaxInt16:
+			w.WriteByte(0xd1)
+			return binary.Write(w, binary.BigEndian, int16(i))
+		case i >= math.MinInt32 && i <= math.MaxInt32:
+			w.WriteByte(0xd2)
+			return binary.Write(w, binary.BigEndian, int32(i))
+		default:
+			w.WriteByte(0xd3)
+			return binary.Write(w, binary.BigEndian, i)
+		}
+	}
+	if u, ok := parseUint(n); ok {
+		w.WriteByte(0xcf)
+		return binary.Write(w, binary.BigEndian, u)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return err
+	}
+	w.WriteByte(0xcb)
+	return binary.Write(w, binary.BigEndian, f)
+}
+
+func readMsgpack(r *bytes.Reader, depth int) (interface{}, error) {
+	if depth > maxNestingDepth {
+		return nil, fmt.Errorf("values nested more than %d levels deep", maxNestingDepth)
+	}
+	code, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xe0 == 0xa0:
+		return readMsgpackString(r, int(code&0x1f))
+	case code&0xf0 == 0x90:
+		return readMsgpackArray(r, int(code&0x0f), depth)
+	case code&0xf0 == 0x80:
+		return readMsgpackMap(r, int(code&0x0f), depth)
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin 8, 16, 32
+		length, err := readLength(r, 1<<(code-0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := readBytes(r, length)
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.EncodeToString(b), nil
+	case 0xca:
+		var f float32
+		err := binary.Read(r, binary.BigEndian, &f)
+		return float64(f), err
+	case 0xcb:
+		var f float64
+		err := binary.Read(r, binary.BigEndian, &f)
+		return f, err
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8, 16, 32, 64
+		u, err := readUint(r, 1<<(code-0xcc))
+		return u, err
+	case 0xd0:
+		var i int8
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd1:
+		var i int16
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd2:
+		var i int32
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd3:
+		var i int64
+		err := binary.Read(r, binary.BigEndian, &i)
+		return i, err
+	case 0xd9, 0xda, 0xdb: // str 8, 16, 32
+		length, err := readLength(r, 1<<(code-0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackString(r, length)
+	case 0xdc, 0xdd: // array 16, 32
+		length, err := readLength(r, 2<<(code-0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(r, length, depth)
+	case 0xde, 0xdf: // map 16, 32
+		length, err := readLength(r, 2<<(code-0xde))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(r, length, depth)
+	default:
+		return nil, fmt.Errorf("unsupported msgpack type 0x%x", code)
+	}
+}
+
+func readMsgpackString(r *bytes.Reader, length int) (interface{}, error) {
+	b, err := readBytes(r, length)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func readMsgpackArray(r *bytes.Reader, length int, depth int) (interface{}, error) {
+	if err := checkLength(r, uint64(length), 1); err != nil {
+		return nil, err
+	}
+	result := make([]interface{}, length)
+	for i := range result {
+		e, err := readMsgpack(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = e
+	}
+	return result, nil
+}
+
+func readMsgpackMap(r *bytes.Reader, length int, depth int) (interface{}, error) {
+	if err := checkLength(r, uint64(length), 2); err != nil {
+		return nil, err
+	}
+	result := make(map[string]interface{}, length)
+	for i := 0; i < length; i++ {
+		k, err := readMsgpack(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readMsgpack(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		result[fmt.Sprint(k)] = v
+	}
+	return result, nil
+}
+
+// readUint reads a big endian unsigned integer of the given size (in bytes)
+func readUint(r *bytes.Reader, size uint) (uint64, error) {
+	b, err := readBytes(r, int(size))
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func readLength(r *bytes.Reader, size uint) (int, error) {
+	u, err := readUint(r, size)
+	if err != nil {
+		return 0, err
+	}
+	if u > math.MaxInt32 {
+		return 0, fmt.Errorf("length too large: %v", u)
+	}
+	return int(u), nil
+}
+
+func readBytes(r *bytes.Reader, length int) ([]byte, error) {
+	if err := checkLength(r, uint64(length), 1); err != nil {
+		return nil, err
+	}
+	b := make([]byte, length)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// checkLength verifies that length items of at least itemSize bytes each fit in what is left of r, so that hostile
+// length prefixes can't cause huge allocations
+func checkLength(r *bytes.Reader, length uint64, itemSize int) error {
+	if length > uint64(r.Len()/itemSize) {
+		return fmt.Errorf("length %v exceeds the %d bytes left", length, r.Len())
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"container/list"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// DefaultNegotiationCacheSize is the default number of (type, Accept) combinations whose negotiation result is kept
+const DefaultNegotiationCacheSize = 256
+
+// negotiationKey identifies a content negotiation: the type of the value to marshall and the accepted media ranges
+type negotiationKey struct {
+	t      reflect.Type
+	accept string
+}
+
+// negotiation is the (memoised) outcome of content negotiation
+type negotiation struct {
+	key         negotiationKey
+	marshaller  Marshaller
+	contentType MediaType
+	err         error
+}
+
+// negotiationCache is a bounded, least recently used, cache of negotiation results. It is safe for concurrent use.
+// A nil cache caches nothing.
+type negotiationCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[negotiationKey]*list.Element
+	lru     list.List // of *negotiation, most recently used first
+}
+
+func newNegotiationCache(size int) *negotiationCache {
+	return &negotiationCache{size: size, entries: make(map[negotiationKey]*list.Element, size)}
+}
+
+// WithNegotiationCacheSize sets the number of content negotiation results that are remembered, so that they need not
+// be computed again for each outgoing message. A size of 0 disables caching.
+func WithNegotiationCacheSize(size int) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		if size > 0 {
+			invoker.negotiations = newNegotiationCache(size)
+		} else {
+			invoker.negotiations = nil
+		}
+	}
+}
+
+// keyFor returns the cache key for marshalling a value of type t according to the given Accept header values
+func keyFor(t reflect.Type, accept []string) negotiationKey {
+	if accept == nil {
+		return negotiationKey{t: t, accept: "\x00"} // as opposed to an empty (but present) Accept header
+	}
+	return negotiationKey{t: t, accept: strings.Join(accept, ",")}
+}
+
+// get returns the negotiation result cached for key, if any
+func (c *negotiationCache) get(key negotiationKey) (*negotiation, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*negotiation), true
+}
+
+// put caches the given negotiation result, evicting the least recently used one if the cache is full
+func (c *negotiationCache) put(n *negotiation) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[n.key]; ok {
+		e.Value = n
+		c.lru.MoveToFront(e)
+		return
+	}
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*negotiation).key)
+	}
+	c.entries[n.key] = c.lru.PushFront(n)
+}
+
+// len returns the number of cached negotiation results
+func (c *negotiationCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
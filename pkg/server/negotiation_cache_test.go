@@ -0,0 +1,178 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/projectriff/go-function-invoker/pkg/function"
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Negotiation cache", func() {
+
+	var invoker *pluginInvoker
+
+	BeforeEach(func() {
+		invoker = &pluginInvoker{
+			marshallers:  []Marshaller{&jsonMarshalling{}, &textMarshalling{}, &xmlMarshalling{}},
+			negotiations: newNegotiationCache(2),
+		}
+	})
+
+	It("should remember negotiation results", func() {
+		payload, contentType, err := invoker.marshallValue(1.5, []string{"application/json"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contentType).To(Equal(MediaType("application/json")))
+		Expect(payload).To(Equal([]byte("1.5\n")))
+
+		n, ok := invoker.negotiations.get(keyFor(reflect.TypeOf(1.5), []string{"application/json"}))
+		Expect(ok).To(BeTrue())
+		Expect(n.marshaller).To(Equal(invoker.marshallers[0]))
+
+		payload, contentType, err = invoker.marshallValue(2.5, []string{"application/json"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contentType).To(Equal(MediaType("application/json")))
+		Expect(payload).To(Equal([]byte("2.5\n")))
+		Expect(invoker.negotiations.len()).To(Equal(1))
+	})
+
+	It("should tell types and Accept headers apart", func() {
+		_, contentType, err := invoker.marshallValue(1.5, []string{"text/plain"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contentType).To(Equal(MediaType("text/plain")))
+		_, contentType, err = invoker.marshallValue(1.5, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contentType).To(Equal(MediaType("text/plain")))
+		_, contentType, err = invoker.marshallValue("riff", []string{"text/plain;charset=iso-8859-1"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contentType).To(Equal(MediaType("text/plain; charset=iso-8859-1")))
+	})
+
+	It("should remember failed negotiations", func() {
+		_, _, err := invoker.marshallValue(1.5, []string{"image/png"})
+		Expect(err).To(MatchError("unsupported content types: [image/png]"))
+		_, _, err = invoker.marshallValue(1.5, []string{"image/png"})
+		Expect(err).To(MatchError("unsupported content types: [image/png]"))
+		Expect(invoker.negotiations.len()).To(Equal(1))
+	})
+
+	It("should evict the least recently used result", func() {
+		json := keyFor(reflect.TypeOf(1.5), []string{"application/json"})
+		text := keyFor(reflect.TypeOf(1.5), []string{"text/plain"})
+		xml := keyFor(reflect.TypeOf(1.5), []string{"application/xml"})
+
+		invoker.marshallValue(1.5, []string{"application/json"})
+		invoker.marshallValue(1.5, []string{"text/plain"})
+		invoker.marshallValue(1.5, []string{"application/json"})
+		invoker.marshallValue(1.5, []string{"application/xml"})
+
+		Expect(invoker.negotiations.len()).To(Equal(2))
+		_, ok := invoker.negotiations.get(json)
+		Expect(ok).To(BeTrue())
+		_, ok = invoker.negotiations.get(text)
+		Expect(ok).To(BeFalse())
+		_, ok = invoker.negotiations.get(xml)
+		Expect(ok).To(BeTrue())
+	})
+
+	It("should be possible to disable", func() {
+		WithNegotiationCacheSize(0)(invoker)
+		_, _, err := invoker.marshallValue(1.5, []string{"application/json"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(invoker.negotiations.len()).To(Equal(0))
+	})
+})
+
+// floatStream is a messageStream that sends the same message a given number of times, and discards results
+type floatStream struct {
+	message *function.Message
+	count   int
+}
+
+func (fs *floatStream) Context() context.Context {
+	return context.Background()
+}
+
+func (fs *floatStream) Recv() (*function.Message, error) {
+	if fs.count == 0 {
+		return nil, io.EOF
+	}
+	fs.count--
+	return fs.message, nil
+}
+
+func (fs *floatStream) Send(message *function.Message, output int) error {
+	return nil
+}
+
+// runningAverage is a streaming function akin to the one in samples/runningaverage
+func runningAverage(in <-chan float32) <-chan float32 {
+	out := make(chan float32)
+	go func() {
+		defer close(out)
+		n, sum := 0, float32(0)
+		for f := range in {
+			sum += f
+			n++
+			out <- sum / float32(n)
+		}
+	}()
+	return out
+}
+
+func benchmarkRunningAverage(b *testing.B, cacheSize int) {
+	Trace.SetOutput(ioutil.Discard)
+	defer Trace.SetOutput(os.Stdout)
+
+	invoker := &pluginInvoker{
+		fn:            reflect.ValueOf(runningAverage),
+		inTypes:       []reflect.Type{reflect.TypeOf(float32(0))},
+		outCount:      1,
+		marshallers:   []Marshaller{&jsonMarshalling{}, &textMarshalling{}, &xmlMarshalling{}, &yamlMarshalling{}},
+		unmarshallers: []Unmarshaller{&jsonMarshalling{}, &textMarshalling{}},
+	}
+	WithNegotiationCacheSize(cacheSize)(invoker)
+	stream := &floatStream{
+		message: &function.Message{Payload: []byte("1.5"), Headers: map[string]*function.Message_HeaderValue{
+			ContentType: {Values: []string{"text/plain"}},
+			Accept:      {Values: []string{"application/json, text/plain;q=0.5"}},
+		}},
+		count: b.N,
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	if err := invoker.invoke(stream, nil); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkRunningAverageCached(b *testing.B) {
+	benchmarkRunningAverage(b, DefaultNegotiationCacheSize)
+}
+
+func BenchmarkRunningAverageUncached(b *testing.B) {
+	benchmarkRunningAverage(b, 0)
+}
@@ -27,44 +27,138 @@ import (
 	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 const (
 	// Headers
 
-	ContentType   = "Content-Type"
-	Accept        = "Accept"
-	CorrelationId = "correlationId"
-	Error         = "error"
+	ContentType     = "Content-Type"
+	Accept          = "Accept"
+	AcceptCharset   = "Accept-Charset"
+	ContentEncoding = "Content-Encoding"
+	AcceptEncoding  = "Accept-Encoding"
+	CorrelationId   = "correlationId"
+	Error           = "error"
+	Input           = "riff-input"  // index or name of the input stream a message is routed to (defaults to 0)
+	Output          = "riff-output" // name (or index) of the output stream a message comes from, for functions with several outputs
 
 	// Url query parameter that identifies the exported function to execute
 	Handler = "handler"
 
+	// Optional lifecycle hooks exported by the plugin
+	InitSymbol    = "Init"
+	DestroySymbol = "Destroy"
+
 	AssumedContentType = MediaType("text/plain")
 
 	// Errors
 
-	ContentTypeNotSupported = errorCode("error-client-content-type-unsupported")
-	AcceptNotSupported      = errorCode("error-client-accept-type-unsupported")
-	ErrorWhileUnmarshalling = errorCode("error-client-unmarshall")
-	ErrorWhileMarshalling   = errorCode("error-client-marshall")
-	InvocationError         = errorCode("error-server-function-invocation")
+	ContentTypeNotSupported     = errorCode("error-client-content-type-unsupported")
+	InputNotSupported           = errorCode("error-client-input-unsupported")
+	ContentEncodingNotSupported = errorCode("error-client-content-encoding-unsupported")
+	ProtocolError               = errorCode("error-client-protocol")
+	AcceptNotSupported          = errorCode("error-client-accept-type-unsupported")
+	ErrorWhileUnmarshalling     = errorCode("error-client-unmarshall")
+	ErrorWhileMarshalling       = errorCode("error-client-marshall")
+	InvocationError             = errorCode("error-server-function-invocation")
+	InputSchemaViolation        = errorCode("error-client-input-schema-violation")
+	OutputSchemaViolation       = errorCode("error-server-output-schema-violation")
+	RateLimitExceeded           = errorCode("error-client-rate-limit-exceeded")
+	ConcurrencyLimitExceeded    = errorCode("error-server-concurrency-limit-exceeded")
+	MessageTooLarge             = errorCode("error-server-message-too-large")
 )
 
 type pluginInvoker struct {
-	// user function to invoke, in 'canonical' func (in <-chan X) (out <-chan Y [, errs <-chan error]) form.
+	// user function to invoke, in 'canonical' func (in <-chan X...) (out <-chan Y... [, errs <-chan error]) form.
 	fn            reflect.Value
-	inType        reflect.Type // The in channel elem type.
+	handler       string         // The name the function is exported as
+	inTypes       []reflect.Type // The in channels elem types (as unmarshalled, see tagged).
+	outCount      int            // The number of out channels, not counting the optional errs channel
+	tagged        bool           // Whether fn exchanges tagged values rather than plain ones, see tagged
+	// When fn wraps a 'direct' or batching function, the wrapper itself, which gives up once done is closed
+	wrapper func(args []reflect.Value, done <-chan struct{}) []reflect.Value
 	marshallers   []Marshaller
 	unmarshallers []Unmarshaller
+	negotiations  *negotiationCache // remembers marshallers chosen by type and Accept, see WithNegotiationCacheSize
+
+	// optional lifecycle hooks, looked up in the plugin as InitSymbol and DestroySymbol
+	initFn    func(config map[string]string) error
+	destroyFn func() error
+	config    map[string]string // passed to initFn
+
+	configStruct reflect.Value // optional struct exported by the plugin as ConfigSymbol, filled from config
+
+	// optional JSON Schemas that inputs and outputs should conform to, see lookupSchemas
+	inputSchema  *jsonSchema
+	outputSchema *jsonSchema
+
+	// when batchSize > 0, batched functions are fed batches of (at most batchSize) inputs, see WithBatching
+	batched      bool
+	batchSize    int
+	batchMaxWait time.Duration
+
+	// 'direct' functions returning an error are invoked again according to that policy, see WithRetries
+	retry retryPolicy
+
+	// optional limits on the rate of messages and on concurrency, see WithRateLimits and WithConcurrencyLimits
+	streamRate      float64
+	globalBucket    *tokenBucket
+	streams         semaphore
+	inFlight        semaphore
+	rejectOverLimit bool
+
+	// the input of a stream ends once no message has arrived for that long (if > 0), see WithIdleTimeout
+	idleTimeout time.Duration
+
+	// functions still holding outputs open that long (if > 0) after their input closed are abandoned, see WithLeakGracePeriod
+	leakGracePeriod time.Duration
+
+	// when true, each element of a slice returned by a 'direct' function is sent as its own message
+	split bool
+
+	// the number of values queued for each input of functions with several inputs (0 for unbounded), see WithInputQueueSize
+	inputQueueSize int
+
+	// optional names of the input and output streams, see WithStreamNames
+	inputNames  []string
+	outputNames []string
+
+	// outgoing payloads at least that large are compressed if asked to, see WithCompressionThreshold
+	compressionThreshold int
+
+	// outgoing messages larger than maxSendSize (if > 0) are rejected, and payloads larger than chunkSize (if > 0) are
+	// split across several messages, see WithMaxSendSize and WithChunking. Incoming payloads larger than
+	// maxPayloadSize (if > 0) once reassembled are rejected, see WithMaxPayloadSize
+	maxSendSize    int
+	chunkSize      int
+	maxPayloadSize int
+
+	// messages that fail unmarshalling or invocation are dead-lettered to that output (if >= 0) and/or writer
+	deadLetterOutput int
+	deadLetterWriter io.Writer
+	deadLetterLock   sync.Mutex // guards deadLetterWriter
+
+	// when true, all outputs are wrapped as CloudEvents, see WithCloudEvents
+	cloudEvents bool
+	ceSource    string
+	ceType      string
 }
 
 type errorCode string
 
 type invokerError struct {
-	code    errorCode
-	cause   error
-	message string
+	code        errorCode
+	cause       error
+	message     string
+	contentType MediaType         // the offending content type (or accepted media ranges), if any
+	source      *function.Message // the incoming message that caused the error, if known
+	attempts    int               // the number of invocations made before giving up, if known
 }
 
 var errorType = reflect.TypeOf((*error)(nil)).Elem()
@@ -82,36 +176,121 @@ func init() {
 // type shared captures all coordination state between the two goroutines and the Call()
 // function, to make function signatures more digestible.
 type shared struct {
-	input  reflect.Value // reflects the 'input' channel to the user function
-	output reflect.Value // reflects the 'output' channel of the user function
-	fnErrs reflect.Value // reflects the 'errors' channel of the user function (optional)
+	inputs  []reflect.Value // reflect the 'input' channels to the user function
+	queues  []*inputQueue   // values waiting to be sent to each input, for functions with several inputs
+	outputs []reflect.Value // reflect the 'output' channels of the user function
+	fnErrs  reflect.Value   // reflects the 'errors' channel of the user function (optional)
+
+	sidecar  messageStream
+	sendLock sync.Mutex // guards sidecar.Send, as dead letters may be sent concurrently with outputs
+
+	// content types expected by the sidecar for each output, if known upfront (takes precedence over Accept)
+	expectedContentTypes []string
+
+	rateLimit *tokenBucket // bounds the rate of incoming messages on this stream, if set
 
-	sidecar function.MessageFunction_CallServer
+	chunks map[int]*chunkedPayload // payloads being received in chunks, by input index, see chunkToFunctionArgs
 
-	errs chan error    // used to signal errors to the Call() function
-	done chan struct{} // used to broadcast early cancellation to all parties, and opt out of an otherwise blocking channel operation
+	errs         chan error    // used to signal errors to the Call() function
+	inputsClosed chan struct{} // closed once all 'input' channels are, see WithLeakGracePeriod
+	done       chan struct{} // used to broadcast early cancellation to all parties, and opt out of an otherwise blocking channel operation
+	cancelOnce sync.Once     // guards closing of done
 
 	// TODO: make Accept passing a responsibility of the sidecar
 	// TODO: make correlationId propagation a responsibility of the sidecar
-	acceptC chan []string
+	acceptLock sync.Mutex
+	accept     *acceptHeaders // the most recent accept headers received, if any
+}
+
+// acceptHeaders captures the headers of an incoming message that drive the marshalling of outgoing ones
+type acceptHeaders struct {
+	accept         []string // Accept, with Accept-Charset folded in
+	acceptEncoding []string
+}
+
+// defaultAcceptHeaders apply to outputs until some message carries accept headers
+var defaultAcceptHeaders = &acceptHeaders{accept: []string{"text/plain"}}
+
+// tagged wraps the values exchanged with 'direct' functions, so that each output carries the accept headers of the
+// input message it answers (if any), rather than relying on the most recent ones as for streaming functions.
+type tagged struct {
+	value  interface{}
+	accept *acceptHeaders
+	source   *function.Message // the input message, should its processing fail, see deadLetter
+	attempts int               // the number of invocations it took to produce an output, see WithRetries
+}
+
+var taggedType = reflect.TypeOf(tagged{})
+
+// messageStream abstracts the protocol used to exchange messages with the sidecar, translated to function.Message.
+// The index of the function output a message comes from is passed explicitly to Send.
+type messageStream interface {
+	Context() context.Context
+	Recv() (*function.Message, error)
+	Send(message *function.Message, output int) error
+}
+
+// callServerStream adapts the original MessageFunction protocol, where the output a message comes from
+// is conveyed as the Output header.
+type callServerStream struct {
+	function.MessageFunction_CallServer
+	pi *pluginInvoker
+}
+
+func (cs callServerStream) Send(message *function.Message, output int) error {
+	if cs.pi.outCount > 1 || output >= cs.pi.outCount {
+		message.Headers[Output] = &function.Message_HeaderValue{Values: []string{cs.pi.outputName(output)}}
+	}
+	return cs.MessageFunction_CallServer.Send(message)
 }
 
 func (pi *pluginInvoker) Call(callServer function.MessageFunction_CallServer) error {
-	
-	input := makeChannel(pi.inType)
-	channelValues := pi.fn.Call([]reflect.Value{input})
+	return statusError(pi.invoke(callServerStream{MessageFunction_CallServer: callServer, pi: pi}, nil))
+}
+
+// invoke runs the function against the given stream of messages, until either end of input or an error occurs.
+func (pi *pluginInvoker) invoke(stream messageStream, expectedContentTypes []string) error {
+	if err := pi.admitStream(stream.Context()); err != nil {
+		return err
+	}
+	defer pi.streams.release()
+
+	if pi.idleTimeout > 0 {
+		idle := newIdleStream(stream, pi.idleTimeout)
+		defer idle.stop()
+		stream = idle
+	}
+
+	inputs := make([]reflect.Value, len(pi.inTypes))
+	for i := range pi.inTypes {
+		inputs[i] = makeChannel(pi.fn.Type().In(i).Elem())
+	}
+	done := make(chan struct{})
+	var channelValues []reflect.Value
+	if pi.wrapper != nil {
+		channelValues = pi.wrapper(inputs, done)
+	} else {
+		channelValues = pi.fn.Call(inputs)
+	}
 
 	ss := &shared{
-		input:          input,
-		output:         channelValues[0],
-		sidecar:        callServer,
-		errs:           make(chan error, 1),
-		done:           make(chan struct{}),
-		acceptC:        make(chan []string, 1),
+		inputs:  inputs,
+		outputs: channelValues[:pi.outCount],
+		sidecar: stream,
+
+		expectedContentTypes: expectedContentTypes,
+		rateLimit:            newTokenBucket(pi.streamRate),
+		errs:                 make(chan error, 1+len(channelValues)),
+		inputsClosed:         make(chan struct{}),
+		done:                 done,
+	}
+
+	if len(channelValues) > pi.outCount {
+		ss.fnErrs = channelValues[pi.outCount]
 	}
 
-	if len(channelValues) == 2 {
-		ss.fnErrs = channelValues[1]
+	if len(inputs) > 1 {
+		ss.startQueues(pi.inputQueueSize)
 	}
 
 	// Sidecar => function input
@@ -121,7 +300,7 @@ func (pi *pluginInvoker) Call(callServer function.MessageFunction_CallServer) er
 	go pi.function2Sidecar()(ss)
 
 	var err error
-	for i := 0; i < 2+(len(channelValues)-1); i++ { // Read errors from both goroutines + 1 optional from fn itself
+	for i := 0; i < 1+len(channelValues); i++ { // Read errors from the input goroutine, each output + 1 optional from fn itself
 		err, _ = <-ss.errs // Will read the zero value of error, which is nil, in case none was posted
 		if err != nil {
 			break
@@ -139,48 +318,61 @@ func (pi *pluginInvoker) sidecar2Function() func(*shared) {
 
 			in, err := s.sidecar.Recv()
 			if err == io.EOF {
-				s.input.Close()
-				s.errs <- nil
+				err = s.abortChunks()
+				s.closeInputs()
+				s.errs <- err
 				Trace.Printf("[Sidecar -> Function] Reached EOF\n")
 				break
 			}
 			if err != nil {
 				Trace.Printf("[Sidecar -> Function] Error returned from callServer.Recv: %#v\n", err)
-				s.input.Close()
+				s.abortChunks()
+				s.abortInputs()
+				s.errs <- err
+				break
+			}
+
+			if err := s.throttle(pi); err != nil {
+				if pi.deadLettering() && !s.failed() {
+					if err = pi.deadLetter(s, in, err); err == nil {
+						continue
+					}
+				}
+				s.abortInputs()
 				s.errs <- err
 				break
 			}
 
-			if in.Headers[Accept] != nil {
-				select {
-				case s.acceptC <- in.Headers[Accept].Values:
-				default:
+			accept := acceptHeadersOf(in)
+			if accept != nil {
+				s.setAccept(accept)
+			}
+			source := in
+			var values []interface{}
+			var index int
+			if pi.chunkSize > 0 && len(headerValues(in, ChunkIndex)) > 0 {
+				source, values, index, err = pi.chunkToFunctionArgs(s, in)
+			} else {
+				values, index, err = pi.messageToFunctionArgs(in)
+			}
+			if err != nil && source != nil && pi.deadLettering() {
+				if err = pi.deadLetter(s, source, err); err == nil {
+					continue
 				}
 			}
-			unmarshalled, err := pi.messageToFunctionArgs(in)
 			if err != nil {
 				Trace.Printf("[Sidecar -> Function] Sending %v to errors\n", err)
-				s.input.Close()
+				s.abortInputs()
 				s.errs <- err
 				break
 			}
-			Trace.Printf("[Sidecar -> Function] About to send %v to function\n", unmarshalled)
-
-			//select {
-			//	case input <- unmarshalled:
-			//	case <-done: // by virtue of being closed somewhere else
-			//    break
-			//}
-			cases := []reflect.SelectCase{
-				{Dir: reflect.SelectSend, Chan: s.input, Send: reflect.ValueOf(unmarshalled)},
-				{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.done)},
-			}
-			chosen, _, recvOK := reflect.Select(cases)
-			if chosen == 1 {
-				if recvOK {
-					panic("illegal state: should only fall in this case because done channel was closed")
+			if pi.tagged {
+				for i, v := range values {
+					values[i] = tagged{value: v, accept: accept, source: source}
 				}
-				s.input.Close()
+			}
+			if !s.sendToFunction(values, index) {
+				s.abortInputs()
 				s.errs <- nil
 				break
 			}
@@ -191,23 +383,29 @@ func (pi *pluginInvoker) sidecar2Function() func(*shared) {
 
 func (pi *pluginInvoker) function2Sidecar() func(*shared) {
 	return func(s *shared) {
-		var accept []string
-
-		cases := []reflect.SelectCase{
-			{Dir: reflect.SelectRecv, Chan: s.output},
+		cases := make([]reflect.SelectCase, 0, len(s.outputs)+1)
+		for _, output := range s.outputs {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: output})
 		}
-		open := 1
-		if s.fnErrs.IsValid() { // user function has a (<-chan error) second result
+		open := len(cases)
+		if s.fnErrs.IsValid() { // user function has a (<-chan error) last result
 			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: s.fnErrs})
 			open++
 		}
+		// once input is closed, waits for the grace period given to the function to close its outputs
+		watchdog := len(cases)
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv})
+		var grace *time.Timer
+		if pi.leakGracePeriod > 0 {
+			cases[watchdog].Chan = reflect.ValueOf(s.inputsClosed)
+		}
 
 		for {
 
 			chosen, value, more := reflect.Select(cases)
-			switch chosen {
-			case 0: // output
-				Trace.Printf("[Function -> Sidecar] Returning %v more=%v\n", value, more)
+			switch {
+			case chosen < len(s.outputs): // output
+				Trace.Printf("[Function -> Sidecar] Returning %v from output #%v more=%v\n", value, chosen, more)
 
 				if !more {
 					s.errs <- nil
@@ -216,40 +414,81 @@ func (pi *pluginInvoker) function2Sidecar() func(*shared) {
 					break
 				}
 
-				if accept == nil {
-					select {
-					case v := <-s.acceptC:
-						accept = v
-					default:
-						accept = []string{"text/plain"}
+				result, accept := value.Interface(), s.latestAccept()
+				var source *function.Message
+				attempts := 0
+				if t, ok := result.(tagged); ok {
+					result, source, attempts = t.value, t.source, t.attempts
+					if t.accept != nil {
+						accept = t.accept
 					}
 				}
+				outputAccept := accept.accept
+				if chosen < len(s.expectedContentTypes) && s.expectedContentTypes[chosen] != "" {
+					outputAccept = []string{s.expectedContentTypes[chosen]}
+				}
 
-				marshalled, err := pi.functionResultToMessage(value.Interface(), accept)
+				marshalled, err := pi.functionResultToMessage(result, outputAccept)
+				if err == nil {
+					err = pi.compress(marshalled, accept.acceptEncoding)
+				}
+				if err == nil && attempts > 1 {
+					marshalled.Headers[Attempts] = &function.Message_HeaderValue{Values: []string{strconv.Itoa(attempts)}}
+				}
+				var chunks []*function.Message
+				if err == nil {
+					chunks, err = pi.chunk(marshalled)
+				}
+				if err != nil && source != nil && pi.deadLettering() {
+					if err = pi.deadLetter(s, source, err); err == nil {
+						break
+					}
+				}
 				if err != nil {
 					Trace.Printf("[Function -> Sidecar] Error returned from marshall: %#v\n", err)
 					s.errs <- err
 					cases[chosen].Chan = reflect.ValueOf(nil)
 					open--
-					close(s.done)
+					s.cancel()
 					break
 				}
-
-				err = s.sidecar.Send(marshalled)
+				err = s.sendChunks(chunks, chosen)
 				if err != nil {
 					Trace.Printf("[Function -> Sidecar] Error returned from callServer.Send: %v\n", err)
 					s.errs <- err
 					cases[chosen].Chan = reflect.ValueOf(nil)
 					open--
-					close(s.done)
+					s.cancel()
+					break
+				}
+			case chosen == watchdog:
+				if grace == nil { // input just closed
+					grace = time.NewTimer(pi.leakGracePeriod)
+					defer grace.Stop()
+					cases[watchdog].Chan = reflect.ValueOf(grace.C)
 					break
 				}
-			case 1: // optional error
+				s.errs <- pi.abandon(s.failed())
+				s.cancel()
+				open = 0
+			default: // optional error
+				var err error
+				if more && !value.IsNil() {
+					err = value.Interface().(error)
+				}
+				if be, ok := err.(batchError); ok && pi.deadLettering() {
+					if err = pi.deadLetterBatch(s, be); err == nil {
+						break // the batching function goes on with the next batch
+					}
+				}
 				cases[chosen].Chan = reflect.ValueOf(nil)
 				open--
-				if more && !value.IsNil() {
-					s.errs <- value.Interface().(error)
-					close(s.done)
+				if ie, ok := err.(invokerError); ok && ie.source != nil && pi.deadLettering() {
+					err = pi.deadLetter(s, ie.source, ie)
+				}
+				if err != nil {
+					s.errs <- err
+					s.cancel()
 				} else {
 					s.errs <- nil
 				}
@@ -263,19 +502,229 @@ func (pi *pluginInvoker) function2Sidecar() func(*shared) {
 	}
 }
 
+// setAccept records the accept headers of the most recent message that carried some
+func (s *shared) setAccept(accept *acceptHeaders) {
+	s.acceptLock.Lock()
+	defer s.acceptLock.Unlock()
+	s.accept = accept
+}
+
+// latestAccept returns the accept headers of the most recent message that carried some, or defaults
+func (s *shared) latestAccept() *acceptHeaders {
+	s.acceptLock.Lock()
+	defer s.acceptLock.Unlock()
+	if s.accept == nil {
+		return defaultAcceptHeaders
+	}
+	return s.accept
+}
+
+// acceptHeadersOf returns the accept headers carried by the given message, or nil if there are none
+func acceptHeadersOf(in *function.Message) *acceptHeaders {
+	if in.Headers[Accept] == nil && in.Headers[AcceptCharset] == nil && in.Headers[AcceptEncoding] == nil {
+		return nil
+	}
+	return &acceptHeaders{
+		accept:         withAcceptCharset(headerValues(in, Accept), headerValues(in, AcceptCharset)),
+		acceptEncoding: headerValues(in, AcceptEncoding),
+	}
+}
+
+// sendToFunction sends each of the given values to the function input at the given index, in order, or queues them
+// for functions with several inputs (see inputQueue), waiting for room in the queue if need be. It returns false if
+// cancellation happened in the meantime.
+func (s *shared) sendToFunction(values []interface{}, index int) bool {
+	if s.queues != nil {
+		select {
+		case <-s.done:
+			return false
+		default:
+		}
+		return s.queues[index].push(values, s.done)
+	}
+	return s.sendToInput(values, index)
+}
 
-func (pi *pluginInvoker) messageToFunctionArgs(in *function.Message) (interface{}, error) {
+// sendToInput sends each of the given values to the function input at the given index, in order.
+// It returns false if cancellation happened in the meantime.
+func (s *shared) sendToInput(values []interface{}, index int) bool {
+	for _, value := range values {
+		Trace.Printf("[Sidecar -> Function] About to send %v to function input #%v\n", value, index)
+
+		//select {
+		//	case inputs[index] <- value:
+		//	case <-done: // by virtue of being closed somewhere else
+		//    return false
+		//}
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectSend, Chan: s.inputs[index], Send: reflect.ValueOf(value)},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.done)},
+		}
+		chosen, _, recvOK := reflect.Select(cases)
+		if chosen == 1 {
+			if recvOK {
+				panic("illegal state: should only fall in this case because done channel was closed")
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// send sends the given message to the sidecar, as coming from the given output
+func (s *shared) send(message *function.Message, output int) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	return s.sidecar.Send(message, output)
+}
+
+// closeInputs signals the end of input data to the user function, once it has been sent the values queued so far
+func (s *shared) closeInputs() {
+	s.endInputs(false)
+}
+
+// abortInputs signals the end of input data to the user function after a failure, dropping the values still queued,
+// and cancels the stream
+func (s *shared) abortInputs() {
+	s.endInputs(true)
+	s.cancel()
+}
+
+func (s *shared) endInputs(discard bool) {
+	if s.queues != nil {
+		for _, q := range s.queues {
+			q.close(discard)
+		}
+		return // inputs get closed by the goroutines feeding them, see startQueues
+	}
+	for _, input := range s.inputs {
+		input.Close()
+	}
+	close(s.inputsClosed)
+}
+
+// failed returns true once the stream has been cancelled, following an error
+func (s *shared) failed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// cancel broadcasts early cancellation to all parties. It is safe to call several times.
+func (s *shared) cancel() {
+	s.cancelOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// inputIndex returns the index of the input stream the given message should be routed to, according to its
+// Input header (which may hold either an index or a name, see WithStreamNames).
+func (pi *pluginInvoker) inputIndex(in *function.Message) (int, error) {
+	h, ok := in.Headers[Input]
+	if !ok || len(h.Values) == 0 {
+		return 0, nil
+	}
+	for i, name := range pi.inputNames {
+		if name == h.Values[0] {
+			return i, nil
+		}
+	}
+	index, err := strconv.Atoi(h.Values[0])
+	if err != nil || index < 0 || index >= len(pi.inTypes) {
+		return 0, invokerError{code: InputNotSupported, message: "Unknown input: " + h.Values[0]}
+	}
+	return index, nil
+}
+
+// headerValues returns the values of the given header of a message, if any
+func headerValues(in *function.Message, header string) []string {
+	if h, ok := in.Headers[header]; ok {
+		return h.Values
+	}
+	return nil
+}
+
+// outputName returns the name of the output stream at the given index, or the index itself if it has no name
+func (pi *pluginInvoker) outputName(index int) string {
+	if index < len(pi.outputNames) {
+		return pi.outputNames[index]
+	}
+	return strconv.Itoa(index)
+}
+
+// messageToFunctionArgs unmarshalls the given message into the value(s) to send to the function input at the returned
+// index. Several values are returned when the payload holds several records, see records.
+func (pi *pluginInvoker) messageToFunctionArgs(in *function.Message) ([]interface{}, int, error) {
+	index, err := pi.inputIndex(in)
+	if err != nil {
+		return nil, 0, err
+	}
+	inType := pi.inTypes[index]
+
+	payload, err := decompress(in, pi.maxPayloadSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	in = &function.Message{Payload: payload, Headers: in.Headers}
 	contentType := AssumedContentType
 	if ct, ok := in.Headers[ContentType]; ok {
 		contentType = MediaType(ct.Values[0])
 	}
-	for _, um := range pi.unmarshallers {
-		if um.canUnmarshall(pi.inType, contentType) {
-			result, err := um.unmarshall(bytes.NewReader(in.Payload), pi.inType, contentType)
-			if err != nil {
-				return nil, invokerError{code: ErrorWhileUnmarshalling, cause: err}
-			} else {
-				return result, nil
+	event, err := decodeCloudEvent(in)
+	if err != nil {
+		return nil, 0, invokerError{code: ErrorWhileUnmarshalling, cause: err}
+	}
+	if event != nil {
+		payload, contentType = event.data, event.dataContentType
+	}
+	if err := pi.validateInput(payload, contentType); err != nil {
+		return nil, 0, err
+	}
+
+	if dataField, ok := cloudEventDataField(inType); ok {
+		data, err := pi.unmarshallPayload(payload, dataField.Type, contentType)
+		if err != nil {
+			return nil, 0, err
+		}
+		values := asValues(data)
+		for i, v := range values {
+			values[i] = newCloudEventEnvelope(inType, event, v)
+		}
+		return values, index, nil
+	}
+	result, err := pi.unmarshallPayload(payload, inType, contentType)
+	if err != nil {
+		return nil, 0, err
+	}
+	return asValues(result), index, nil
+}
+
+// asValues expands records into their individual values
+func asValues(unmarshalled interface{}) []interface{} {
+	if r, ok := unmarshalled.(records); ok {
+		return r
+	}
+	return []interface{}{unmarshalled}
+}
+
+// unmarshallPayload turns the given payload into an instance of t, using the first unmarshaller that supports
+// contentType or else, for media types with a structured syntax suffix (such as +json), the type the suffix stands for.
+func (pi *pluginInvoker) unmarshallPayload(payload []byte, t reflect.Type, contentType MediaType) (interface{}, error) {
+	for _, mediaType := range []MediaType{contentType, suffixBase(contentType)} {
+		if mediaType == "" {
+			continue
+		}
+		for _, um := range pi.unmarshallers {
+			if um.canUnmarshall(t, mediaType) {
+				result, err := um.unmarshall(bytes.NewReader(payload), t, mediaType)
+				if err != nil {
+					return nil, invokerError{code: ErrorWhileUnmarshalling, cause: err, contentType: contentType}
+				} else {
+					return result, nil
+				}
 			}
 		}
 	}
@@ -284,38 +733,94 @@ func (pi *pluginInvoker) messageToFunctionArgs(in *function.Message) (interface{
 
 func (invoker *pluginInvoker) functionResultToMessage(value interface{}, accept []string) (*function.Message, error) {
 
-	var payload []byte
-	var contentType MediaType
+	if err := invoker.validateOutput(value); err != nil {
+		return nil, err
+	}
+
+	if invoker.cloudEvents || acceptsCloudEvents(accept) || isCloudEventEnvelope(reflect.TypeOf(value)) {
+		return invoker.cloudEventToMessage(value, accept)
+	}
+
+	payload, contentType, err := invoker.marshallValue(value, accept)
+	if err != nil {
+		return nil, err
+	}
 
-	// successful invocation
+	return &function.Message{Payload: payload,
+		Headers: map[string]*function.Message_HeaderValue{ContentType: &function.Message_HeaderValue{Values: []string{string(contentType)}}}}, nil
+
+}
+
+// marshallValue turns the given value into bytes, using the marshaller that best fits the accepted media types
+func (invoker *pluginInvoker) marshallValue(value interface{}, accept []string) ([]byte, MediaType, error) {
+	chosen, contentType, err := invoker.negotiate(reflect.TypeOf(value), accept)
+	if err != nil {
+		return nil, "", err
+	}
+	var buffer bytes.Buffer
+	err = chosen.marshall(value, &buffer, contentType)
+	if err != nil {
+		return nil, "", invokerError{code: ErrorWhileMarshalling, cause: err, contentType: contentType}
+	}
+	return buffer.Bytes(), contentType, nil
+}
+
+// negotiate returns the marshaller that best fits the accepted media types for values of type t, together with the
+// media type (and charset) to marshall to. Results are remembered in the negotiation cache.
+func (invoker *pluginInvoker) negotiate(t reflect.Type, accept []string) (Marshaller, MediaType, error) {
+	key := keyFor(t, accept)
+	if n, ok := invoker.negotiations.get(key); ok {
+		return n.marshaller, n.contentType, n.err
+	}
+
+	n := &negotiation{key: key}
 	supportedMarshallers := make(map[MediaType]Marshaller)
+	var offers []MediaType // in order of marshallers precedence
 	for _, m := range invoker.marshallers {
-		t := reflect.TypeOf(value)
-		offers := m.supportedMediaTypes(t)
-		for _, o := range offers {
+		for _, o := range m.supportedMediaTypes(t) {
 			if _, present := supportedMarshallers[o]; !present {
 				supportedMarshallers[o] = m
+				offers = append(offers, o)
 			}
 		}
 	}
-	chosen, contentType := bestMarshaller(accept, supportedMarshallers)
-	if chosen != nil {
-		var buffer bytes.Buffer
-		err := chosen.marshall(value, &buffer, contentType)
-		if err != nil {
-			return nil, invokerError{code: ErrorWhileMarshalling, cause: err}
+	offers = withSuffixOffers(accept, offers, supportedMarshallers)
+	n.marshaller, n.contentType = bestMarshaller(accept, offers, supportedMarshallers)
+	if n.marshaller == nil {
+		n.err = invokerError{code: AcceptNotSupported, cause: fmt.Errorf("unsupported content types: %v", accept),
+			contentType: MediaType(strings.Join(accept, ", "))}
+	} else if _, ok := n.marshaller.(charsetMarshaller); ok {
+		charset := negotiateCharset(accept, n.contentType)
+		if _, err := charsetEncoding(charset); err != nil {
+			n.err = invokerError{code: AcceptNotSupported, cause: err, contentType: n.contentType}
 		}
-		payload = buffer.Bytes()
-	} else {
-		return nil, invokerError{code: AcceptNotSupported, cause: fmt.Errorf("unsupported content types: %v", accept)}
+		n.contentType = withCharset(n.contentType, charset)
 	}
+	invoker.negotiations.put(n)
+	return n.marshaller, n.contentType, n.err
+}
 
-	return &function.Message{Payload: payload,
-		Headers: map[string]*function.Message_HeaderValue{ContentType: &function.Message_HeaderValue{Values: []string{string(contentType)}}}}, nil
+// InvokerOption allows customization of the invoker created by NewInvoker.
+type InvokerOption func(*pluginInvoker)
+
+// WithSplitting makes 'direct' functions that return a slice emit one message per element of that slice, rather
+// than a single message. Note that functions returning a (receiving) channel are always handled that way.
+func WithSplitting() InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.split = true
+	}
+}
 
+// WithStreamNames gives names to the input and output streams of a streaming function, in order. Messages can then be
+// routed to an input by name, and messages coming from an output are tagged with its name.
+func WithStreamNames(inputs []string, outputs []string) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		invoker.inputNames = inputs
+		invoker.outputNames = outputs
+	}
 }
 
-func NewInvoker(fnUri string) (*pluginInvoker, error) {
+func NewInvoker(fnUri string, opts ...InvokerOption) (*pluginInvoker, error) {
 	result := pluginInvoker{}
 
 	url, err := url.Parse(fnUri)
@@ -325,6 +830,29 @@ func NewInvoker(fnUri string) (*pluginInvoker, error) {
 	if url.Scheme != "" && url.Scheme != "file" {
 		return &result, errors.New("Unsupported scheme in function URI: " + fnUri)
 	}
+
+	result.marshallers = []Marshaller{&jsonMarshalling{}, &textMarshalling{}, &xmlMarshalling{}, &yamlMarshalling{},
+		&msgpackMarshalling{}, &cborMarshalling{}, &protobufMarshalling{}, &ndjsonMarshalling{}, &csvMarshalling{}}
+	result.unmarshallers = []Unmarshaller{&readerUnmarshalling{}, &jsonMarshalling{}, &textMarshalling{}, &xmlMarshalling{}, &yamlMarshalling{},
+		&msgpackMarshalling{}, &cborMarshalling{}, &protobufMarshalling{}, &ndjsonMarshalling{}, &csvMarshalling{}}
+	result.negotiations = newNegotiationCache(DefaultNegotiationCacheSize)
+	result.compressionThreshold = DefaultCompressionThreshold
+	result.maxPayloadSize = DefaultMaxPayloadSize
+	result.deadLetterOutput = -1
+	result.leakGracePeriod = DefaultLeakGracePeriod
+	result.inputQueueSize = DefaultInputQueueSize
+	result.ceSource = DefaultCloudEventSource
+	result.ceType = DefaultCloudEventType
+	result.config = make(map[string]string)
+	for k, v := range url.Query() {
+		if k != Handler && k != InputSchemaParam && k != OutputSchemaParam {
+			result.config[k] = v[0]
+		}
+	}
+	for _, opt := range opts {
+		opt(&result)
+	}
+
 	lib, err := plugin.Open(url.Path)
 	if err != nil {
 		return &result, err
@@ -335,52 +863,130 @@ func NewInvoker(fnUri string) (*pluginInvoker, error) {
 		return &result, err
 	}
 	result.fn = reflect.ValueOf(fnSymbol)
+	result.handler = fnName
+	err = result.lookupBatched(lib)
+	if err != nil {
+		return &result, err
+	}
 	err = result.canonicalize()
+	if err != nil {
+		return &result, err
+	}
+	if result.deadLetterOutput >= 0 && result.deadLetterOutput < result.outCount {
+		return &result, fmt.Errorf("dead-letter output #%d clashes with the %d output(s) of the function", result.deadLetterOutput, result.outCount)
+	}
+
+	err = result.lookupLifecycleHooks(lib)
+	if err != nil {
+		return &result, err
+	}
+	err = result.lookupConfigStruct(lib)
+	if err != nil {
+		return &result, err
+	}
+	err = result.lookupSchemas(lib, url.Query())
 
 	Trace.Printf("FUNCTION %v = %#v\n", fnName, result.fn)
 
-	result.marshallers = []Marshaller{&jsonMarshalling{}, &textMarshalling{}}
-	result.unmarshallers = []Unmarshaller{&jsonMarshalling{}, &textMarshalling{}}
 	return &result, err
 
 }
 
+// lookupLifecycleHooks resolves the optional InitSymbol and DestroySymbol functions exported by the plugin.
+// Absent symbols are fine, but symbols of the wrong type are reported as an error.
+func (invoker *pluginInvoker) lookupLifecycleHooks(lib *plugin.Plugin) error {
+	if sym, err := lib.Lookup(InitSymbol); err == nil {
+		initFn, ok := sym.(func(map[string]string) error)
+		if !ok {
+			return fmt.Errorf("exported symbol %v should be a func(map[string]string) error, was %T", InitSymbol, sym)
+		}
+		invoker.initFn = initFn
+	}
+	if sym, err := lib.Lookup(DestroySymbol); err == nil {
+		destroyFn, ok := sym.(func() error)
+		if !ok {
+			return fmt.Errorf("exported symbol %v should be a func() error, was %T", DestroySymbol, sym)
+		}
+		invoker.destroyFn = destroyFn
+	}
+	return nil
+}
+
+// Init fills the optional Config struct exported by the plugin, then invokes the optional Init function exported by
+// the plugin, if any. It is meant to be called once, before the invoker starts accepting calls.
+func (invoker *pluginInvoker) Init() error {
+	if err := invoker.fillConfigStruct(); err != nil {
+		return err
+	}
+	if invoker.initFn == nil {
+		return nil
+	}
+	Trace.Printf("Invoking %v(%v)\n", InitSymbol, invoker.config)
+	return invoker.initFn(invoker.config)
+}
+
+// Destroy invokes the optional Destroy function exported by the plugin, if any. It is meant to be called once, after
+// the invoker has stopped accepting calls.
+func (invoker *pluginInvoker) Destroy() error {
+	if invoker.destroyFn == nil {
+		return nil
+	}
+	Trace.Printf("Invoking %v()\n", DestroySymbol)
+	return invoker.destroyFn()
+}
+
 // canonicalize turns a function value that may be non-streaming, non-error-returning into
 // a value reflecting a "func (in <-chan X) (out <-chan Y, errors <-chan error)" form.
 //
+// Streaming functions may accept several input channels and return several output channels, the last
+// returned channel being used to signal errors if it is of type ([<-]chan error).
+//
 // If the provided function does not accept a channel as first parameter, it is assumed that it is a non-streaming
 // function. In that case, its return type (if present and different from error) must not be a channel type either.
 // Such a function will be wrapped into a function that accepts the desired channel(s) and invokes the provided function f.
 func (invoker *pluginInvoker) canonicalize() error {
 
-	var inputType0, outputType0, outputType1 reflect.Type = nil, nil, nil
+	var inputType0, outputType0 reflect.Type = nil, nil
 	if invoker.fn.Type().NumIn() > 0 {
 		inputType0 = invoker.fn.Type().In(0)
 	}
 	if invoker.fn.Type().NumOut() > 0 {
 		outputType0 = invoker.fn.Type().Out(0)
 	}
-	if invoker.fn.Type().NumOut() > 1 {
-		outputType1 = invoker.fn.Type().Out(1)
-	}
-	if invoker.fn.Type().NumOut() > 2 {
-		return fmt.Errorf("too many return values in %#v", invoker.fn)
-	}
 
 	// Is the function working with channels?
 	if inputType0 != nil && inputType0.Kind() == reflect.Chan &&
 		outputType0 != nil && outputType0.Kind() == reflect.Chan {
-		if !canReceive(inputType0) || !canReceive(outputType0) {
-			return fmt.Errorf("wrong direction of channels in function %#v", invoker.fn)
+		// Already exactly what we want, provided all arguments and results are receiving channels
+		fnType := invoker.fn.Type()
+		invoker.inTypes = make([]reflect.Type, fnType.NumIn())
+		for i := range invoker.inTypes {
+			t := fnType.In(i)
+			if t.Kind() != reflect.Chan {
+				return fmt.Errorf("argument #%d of streaming function should be a channel in %#v", i, invoker.fn)
+			} else if !canReceive(t) {
+				return fmt.Errorf("wrong direction of channels in function %#v", invoker.fn)
+			}
+			invoker.inTypes[i] = t.Elem()
 		}
-
-		if outputType1 == nil || outputType1.Kind() == reflect.Chan && outputType1.Elem() == errorType && canReceive(outputType1) {
-			// Already exactly what we want
-			invoker.inType = inputType0.Elem()
-			return nil
-		} else {
-			return fmt.Errorf("second return type of function should be ([<-]chan error) in %#v", invoker.fn)
+		invoker.outCount = fnType.NumOut()
+		if fnType.Out(fnType.NumOut()-1).Kind() == reflect.Chan && fnType.Out(fnType.NumOut()-1).Elem() == errorType {
+			invoker.outCount--
+		}
+		for i := 0; i < fnType.NumOut(); i++ {
+			t := fnType.Out(i)
+			if t.Kind() != reflect.Chan {
+				return fmt.Errorf("result #%d of streaming function should be a channel in %#v", i, invoker.fn)
+			} else if !canReceive(t) {
+				return fmt.Errorf("wrong direction of channels in function %#v", invoker.fn)
+			}
+		}
+		if invoker.outCount == 0 {
+			return fmt.Errorf("streaming function should have at least one output channel in %#v", invoker.fn)
 		}
+		return nil
+	} else if invoker.batched && invoker.batchSize > 0 {
+		return invoker.canonicalizeBatch()
 	} else {
 		// The original fn could have any of the following forms:
 		// f(X) (Y, error)
@@ -395,12 +1001,14 @@ func (invoker *pluginInvoker) canonicalize() error {
 		oldFn := invoker.fn
 
 		// TODO: check IN or OUT are not channel
-		invoker.inType = reflect.TypeOf(struct{}{})
+		inType := reflect.TypeOf(struct{}{})
 		if oldFn.Type().NumIn() > 1 {
 			return fmt.Errorf("too many arguments to non streaming function: %#v", oldFn)
 		} else if isAcceptingInput(oldFn) {
-			invoker.inType = oldFn.Type().In(0)
+			inType = oldFn.Type().In(0)
 		}
+		invoker.inTypes = []reflect.Type{inType}
+		invoker.outCount = 1
 
 		outType := reflect.TypeOf(struct{}{})
 		if oldFn.Type().NumOut() > 2 {
@@ -409,9 +1017,23 @@ func (invoker *pluginInvoker) canonicalize() error {
 			outType = oldFn.Type().Out(0)
 		}
 
-		wrapper := func(args []reflect.Value) []reflect.Value {
+		// Returned channels are always fanned out into one message per element. Slices only are if asked to.
+		fanOut := false
+		if outType.Kind() == reflect.Chan {
+			if !canReceive(outType) {
+				return fmt.Errorf("wrong direction of returned channel in function %#v", oldFn)
+			}
+			fanOut = true
+		} else if invoker.split && outType.Kind() == reflect.Slice {
+			fanOut = true
+		}
+
+		// Inputs and outputs are tagged, so that the output is marshalled according to the input it answers
+		// The wrapper gives up (rather than block forever) once done is closed, that is when the stream fails or the
+		// function is abandoned
+		wrapper := func(args []reflect.Value, done <-chan struct{}) []reflect.Value {
 			in := args[0]
-			out := makeChannel(outType)
+			out := makeChannel(taggedType)
 			errs := makeChannel(errorType)
 
 			go func() {
@@ -420,40 +1042,114 @@ func (invoker *pluginInvoker) canonicalize() error {
 
 				i, open := in.Recv()
 				Trace.Printf("[-Function Wrapper->] In function, input = %#v, open=%v\n", i, open)
+				if !open && isAcceptingInput(oldFn) {
+					// input closed early, because of earlier (eg unmarshalling) error. Do nothing
+					return
+				}
+				if err := invoker.admitInvocation(done); err != nil {
+					sendUnlessDone(errs, reflect.ValueOf(&err).Elem(), done)
+					return
+				}
+				defer invoker.inFlight.release()
+
 				var fnResult []reflect.Value
+				var accept *acceptHeaders
+				var source *function.Message
+				attempts := 0
 				if open {
 					// original function receiving actual input
-					fnResult = oldFn.Call([] reflect.Value{i})
-				} else if !isAcceptingInput(oldFn) {
-					// input channel closed immediately. Invoke original zero-arg fn
-					fnResult = oldFn.Call([]reflect.Value{})
+					t := i.Interface().(tagged)
+					arg := reflect.Zero(inType)
+					if t.value != nil {
+						arg = reflect.ValueOf(t.value)
+					}
+					accept, source = t.accept, t.source
+					if rc, ok := t.value.(readCloser); ok {
+						// discard whatever chunks the function did not read
+						defer rc.Close()
+					}
+					retry := invoker.retry
+					if inType == readerType {
+						// the first attempt consumes the input, which can't be read again
+						retry = retryPolicy{}
+					}
+					fnResult, attempts = retry.callWithRetries(oldFn, []reflect.Value{arg}, done)
 				} else {
-					// input closed early, because of earlier (eg unmarshalling) error. Do nothing
-					return
+					// input channel closed immediately. Invoke original zero-arg fn
+					fnResult, attempts = invoker.retry.callWithRetries(oldFn, []reflect.Value{}, done)
 				}
 
 				Trace.Printf("[-Function Wrapper->] In function, result = %#v\n", unwrap(fnResult))
 				if isErroring(oldFn) && !fnResult[oldFn.Type().NumOut()-1].IsNil() {
 					Trace.Printf("[-Function Wrapper->] Sending error %#v", fnResult[oldFn.Type().NumOut()-1])
-					errs.Send(fnResult[oldFn.Type().NumOut()-1])
+					cause := fnResult[oldFn.Type().NumOut()-1].Interface().(error)
+					code := InvocationError
+					if ie, ok := cause.(invokerError); ok {
+						// the function passed on an error of the invoker, such as that of its input reader
+						code = ie.code
+					}
+					var err error = invokerError{code: code, source: source, attempts: attempts, cause: cause}
+					sendUnlessDone(errs, reflect.ValueOf(&err).Elem(), done)
+				} else if hasReturnValue(oldFn) && fanOut {
+					Trace.Printf("[-Function Wrapper->] Sending elements of result %#v", fnResult[0])
+					sendElements(out, fnResult[0], tagged{accept: accept, attempts: attempts}, done)
 				} else if hasReturnValue(oldFn) {
 					Trace.Printf("[-Function Wrapper->] Sending result %#v", fnResult[0])
-					out.Send(fnResult[0])
+					sendUnlessDone(out, reflect.ValueOf(tagged{value: fnResult[0].Interface(), accept: accept, attempts: attempts}), done)
 				}
 			}()
 			return []reflect.Value{out, errs}
 		}
 
-		cInType := reflect.ChanOf(reflect.RecvDir, invoker.inType)
-		cOutType := reflect.ChanOf(reflect.BothDir, outType)
+		cInType := reflect.ChanOf(reflect.RecvDir, taggedType)
+		cOutType := reflect.ChanOf(reflect.BothDir, taggedType)
 		cErrorType := reflect.ChanOf(reflect.BothDir, errorType)
 		t := reflect.FuncOf([]reflect.Type{cInType}, []reflect.Type{cOutType, cErrorType}, false)
-		invoker.fn = reflect.MakeFunc(t, wrapper)
+		invoker.fn = reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value { return wrapper(args, nil) })
+		invoker.wrapper = wrapper
+		invoker.tagged = true
 
 		return nil
 	}
 }
 
+// sendElements sends each element of the given slice or (receiving) channel to out, in order, tagged like tag.
+// It gives up as soon as done is closed.
+func sendElements(out reflect.Value, elements reflect.Value, tag tagged, done <-chan struct{}) {
+	if elements.Kind() == reflect.Slice {
+		for i := 0; i < elements.Len(); i++ {
+			tag.value = elements.Index(i).Interface()
+			if !sendUnlessDone(out, reflect.ValueOf(tag), done) {
+				return
+			}
+		}
+	} else if !elements.IsNil() {
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: elements},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)},
+		}
+		for {
+			chosen, v, more := reflect.Select(cases)
+			if chosen == 1 || !more {
+				return
+			}
+			tag.value = v.Interface()
+			if !sendUnlessDone(out, reflect.ValueOf(tag), done) {
+				return
+			}
+		}
+	}
+}
+
+// sendUnlessDone sends v to the given channel, unless done is closed first. It returns whether v was sent.
+func sendUnlessDone(ch reflect.Value, v reflect.Value, done <-chan struct{}) bool {
+	chosen, _, _ := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: ch, Send: v},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)},
+	})
+	return chosen == 0
+}
+
 // isAcceptingInput returns true if the Value provided (representing a func value) accepts exactly one parameter
 func isAcceptingInput(oldFn reflect.Value) bool {
 	return oldFn.Type().NumIn() == 1
@@ -477,8 +1173,9 @@ func canReceive(inputType0 reflect.Type) bool {
 
 func unsupportedContentType(ct MediaType) invokerError {
 	return invokerError{
-		code:    ContentTypeNotSupported,
-		message: "Unsupported Content-Type: " + string(ct),
+		code:        ContentTypeNotSupported,
+		message:     "Unsupported Content-Type: " + string(ct),
+		contentType: ct,
 	}
 }
 
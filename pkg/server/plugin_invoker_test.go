@@ -14,12 +14,26 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/types"
 	"google.golang.org/grpc"
 	"math/rand"
 	"net"
 	"io"
 	"net/http"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -54,7 +68,10 @@ var _ = Describe("PluginInvoker", func() {
 	var (
 		invoker    *pluginInvoker
 		handler    string
+		query      string
+		options    []InvokerOption
 		gRpcServer *grpc.Server
+		conn       *grpc.ClientConn
 		sidecar    function.MessageFunction_CallClient
 		cancel     context.CancelFunc
 	)
@@ -62,8 +79,9 @@ var _ = Describe("PluginInvoker", func() {
 	JustBeforeEach(func() {
 		var err error
 
-		invoker, err = NewInvoker(fmt.Sprintf("%s?%s=%s", builtPlugin, Handler, handler))
+		invoker, err = NewInvoker(fmt.Sprintf("%s?%s=%s%s", builtPlugin, Handler, handler, query), options...)
 		Expect(err).NotTo(HaveOccurred())
+		Expect(invoker.Init()).To(Succeed())
 
 		port := 1024 + rand.Intn(65536-1024)
 
@@ -75,7 +93,7 @@ var _ = Describe("PluginInvoker", func() {
 		}()
 
 		ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
-		conn, err := grpc.DialContext(ctx, fmt.Sprintf("localhost:%v", port), grpc.WithInsecure(), grpc.WithBlock())
+		conn, err = grpc.DialContext(ctx, fmt.Sprintf("localhost:%v", port), grpc.WithInsecure(), grpc.WithBlock())
 		Expect(err).NotTo(HaveOccurred())
 
 		ctx, cancel = context.WithCancel(context.Background())
@@ -87,7 +105,11 @@ var _ = Describe("PluginInvoker", func() {
 	})
 
 	AfterEach(func() {
+		cancel()
 		gRpcServer.Stop()
+		Expect(invoker.Destroy()).To(Succeed())
+		query = ""
+		options = nil
 	})
 
 	Context("with 'direct' functions", func() {
@@ -155,6 +177,23 @@ var _ = Describe("PluginInvoker", func() {
 			Expect(result.Payload).To(Equal([]byte("Hello world")))
 		})
 
+		It("should understand and echo vendor types with a structured syntax suffix", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := sidecar.Send(msg(`"world"`, "Content-Type", "application/vnd.acme.greeting+json; charset=utf-8",
+					"Accept", "application/vnd.acme.greeting+json, text/plain;q=0.5"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(result.Headers[ContentType].Values).To(Equal([]string{"application/vnd.acme.greeting+json"}))
+			Expect(result.Payload).To(Equal([]byte("\"Hello world\"\n")))
+		})
+
 		It("should cope with Close() in any order", func() {
 			err := sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "text/plain"))
 			Expect(err).NotTo(HaveOccurred())
@@ -162,140 +201,1507 @@ var _ = Describe("PluginInvoker", func() {
 			result, err := sidecar.Recv()
 			Expect(err).NotTo(HaveOccurred())
 
-			Expect(result.Payload).To(Equal([]byte("Hello world")))
+			Expect(result.Payload).To(Equal([]byte("Hello world")))
+
+			err = sidecar.CloseSend()
+			Expect(err).NotTo(HaveOccurred())
+			result, err = sidecar.Recv()
+			Expect(err).To(MatchError(io.EOF))
+		})
+
+		It("idiomatic go errors are propagated back", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := sidecar.Send(msg("Riff", "Content-Type", "text/plain", "Accept", "text/plain"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			_, err := sidecar.Recv()
+			Expect(err).To(MatchError(ContainSubstring("error condition")))
+
+		})
+
+		It("unmarshalling errors abort and are propagated", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := sidecar.Send(msg("world", "Content-Type", "text/foobar", "Accept", "text/plain"))
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			_, err := sidecar.Recv()
+			Expect(err).To(MatchError(ContainSubstring("Unsupported Content-Type: text/foobar")))
+		})
+
+		It("marshalling errors abort and are propagated", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "text/foobar"))
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			_, err := sidecar.Recv()
+			Expect(err).To(MatchError(ContainSubstring("unsupported content types: [text/foobar]")))
+		})
+
+		It("should report errors as gRPC statuses with details", func() {
+			err := sidecar.Send(msg("world", "Content-Type", "text/foobar", "Accept", "text/plain"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = sidecar.Recv()
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+			s, ok := status.FromError(err)
+			Expect(ok).To(BeTrue())
+			Expect(s.Details()).To(Equal([]interface{}{
+				&ErrorInfo{Reason: "error-client-content-type-unsupported", Domain: ErrorDomain, Metadata: map[string]string{
+					ErrorInfoCause:       "Unsupported Content-Type: text/foobar",
+					ErrorInfoContentType: "text/foobar",
+				}},
+				&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+					Field:       "Content-Type",
+					Description: "Unsupported Content-Type: text/foobar",
+				}}},
+			}))
+		})
+
+		It("should report function errors as internal errors", func() {
+			err := sidecar.Send(msg("Riff", "Content-Type", "text/plain", "Accept", "text/plain"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = sidecar.Recv()
+			Expect(status.Code(err)).To(Equal(codes.Internal))
+			s, _ := status.FromError(err)
+			Expect(s.Details()).To(HaveLen(1))
+			Expect(s.Details()[0].(*ErrorInfo).Reason).To(Equal("error-server-function-invocation"))
+		})
+
+		It("should report unacceptable outputs as failed preconditions", func() {
+			err := sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "text/foobar"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = sidecar.Recv()
+			Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+			s, _ := status.FromError(err)
+			Expect(s.Details()[0].(*ErrorInfo).Metadata[ErrorInfoContentType]).To(Equal("text/foobar"))
+			violation := s.Details()[1].(*errdetails.PreconditionFailure).Violations[0]
+			Expect(violation.Type).To(Equal("error-client-accept-type-unsupported"))
+			Expect(violation.Subject).To(Equal("text/foobar"))
+		})
+
+		It("should report results that can't be marshalled as internal errors", func() {
+			Expect(invokerError{code: ErrorWhileMarshalling, message: "unmarshallable"}.status().Code()).To(Equal(codes.Internal))
+		})
+
+		It("should transcode charsets", func() {
+			err := sidecar.Send(msg("caf\xe9", "Content-Type", "text/plain; charset=ISO-8859-1", "Accept", "text/plain; charset=iso-8859-1"))
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Headers[ContentType].Values).To(Equal([]string{"text/plain; charset=iso-8859-1"}))
+			Expect(result.Payload).To(Equal([]byte("Hello caf\xe9")))
+		})
+
+		It("should honor Accept-Charset", func() {
+			err := sidecar.Send(msg("caf\u00e9", "Accept", "application/json", "Accept-Charset", "utf-8;q=0.5, utf-16be"))
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Headers[ContentType].Values).To(Equal([]string{"application/json; charset=utf-16be"}))
+			Expect(result.Payload).To(Equal([]byte("\x00\"\x00H\x00e\x00l\x00l\x00o\x00 \x00c\x00a\x00f\x00\xe9\x00\"\x00\n")))
+		})
+
+		Context("with JSON Schemas", func() {
+			var dir string
+
+			BeforeEach(func() {
+				var err error
+				dir, err = ioutil.TempDir("", "schemas")
+				Expect(err).NotTo(HaveOccurred())
+				in := filepath.Join(dir, "in.json")
+				Expect(ioutil.WriteFile(in, []byte(`{"type": "string", "minLength": 3}`), 0644)).To(Succeed())
+				out := filepath.Join(dir, "out.json")
+				Expect(ioutil.WriteFile(out, []byte(`{"type": "string", "pattern": "^Hello [a-z]+$"}`), 0644)).To(Succeed())
+				query = fmt.Sprintf("&%s=%s&%s=%s", InputSchemaParam, in, OutputSchemaParam, out)
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(dir)
+			})
+
+			It("should accept conforming values", func() {
+				err := sidecar.Send(msg(`"world"`, "Content-Type", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte("Hello world")))
+			})
+
+			It("should reject inputs that violate the schema", func() {
+				err := sidecar.Send(msg(`"me"`, "Content-Type", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = sidecar.Recv()
+				Expect(err).To(MatchError(ContainSubstring("Input does not conform to schema: /: should be at least 3 characters long")))
+			})
+
+			It("should reject outputs that violate the schema", func() {
+				err := sidecar.Send(msg(`"World"`, "Content-Type", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = sidecar.Recv()
+				Expect(err).To(MatchError(ContainSubstring("Output does not conform to schema: /: should match pattern ^Hello [a-z]+$")))
+			})
+
+			It("should not pass schema locations as configuration", func() {
+				Expect(invoker.config).NotTo(HaveKey(InputSchemaParam))
+			})
+
+			It("should report the path of invalid schemas", func() {
+				circular := filepath.Join(dir, "circular.json")
+				Expect(ioutil.WriteFile(circular, []byte(`{"$ref": "#"}`), 0644)).To(Succeed())
+				_, err := NewInvoker(fmt.Sprintf("%s?%s=%s&%s=%s", builtPlugin, Handler, handler, InputSchemaParam, circular))
+				Expect(err).To(MatchError(circular + ": invalid JSON Schema: circular $ref #"))
+			})
+		})
+
+		Context("with compression", func() {
+			BeforeEach(func() {
+				options = []InvokerOption{WithCompressionThreshold(8)}
+			})
+
+			It("should decompress incoming payloads", func() {
+				var buffer bytes.Buffer
+				w := gzip.NewWriter(&buffer)
+				w.Write([]byte("world"))
+				w.Close()
+				err := sidecar.Send(msg(buffer.String(), "Content-Encoding", "gzip"))
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte("Hello world")))
+				Expect(result.Headers).NotTo(HaveKey(ContentEncoding))
+			})
+
+			It("should compress outgoing payloads above the threshold", func() {
+				err := sidecar.Send(msg("compression", "Accept-Encoding", "gzip;q=0.5, deflate, zstd"))
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Headers[ContentEncoding].Values).To(Equal([]string{"deflate"}))
+				r, err := zlib.NewReader(bytes.NewReader(result.Payload))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.ReadAll(r)).To(Equal([]byte("Hello compression")))
+			})
+
+			It("should not compress small payloads", func() {
+				err := sidecar.Send(msg("!", "Accept-Encoding", "gzip"))
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte("Hello !")))
+				Expect(result.Headers).NotTo(HaveKey(ContentEncoding))
+			})
+
+			It("should support zstd both ways", func() {
+				var buffer bytes.Buffer
+				w, err := zstd.NewWriter(&buffer)
+				Expect(err).NotTo(HaveOccurred())
+				w.Write([]byte("zstandard"))
+				w.Close()
+				err = sidecar.Send(msg(buffer.String(), "Content-Encoding", "zstd", "Accept-Encoding", "zstd"))
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Headers[ContentEncoding].Values).To(Equal([]string{"zstd"}))
+				r, err := zstd.NewReader(bytes.NewReader(result.Payload))
+				Expect(err).NotTo(HaveOccurred())
+				defer r.Close()
+				Expect(ioutil.ReadAll(r)).To(Equal([]byte("Hello zstandard")))
+			})
+
+			It("should reject unsupported encodings", func() {
+				err := sidecar.Send(msg("world", "Content-Encoding", "br"))
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = sidecar.Recv()
+				Expect(err).To(MatchError(ContainSubstring("Unsupported Content-Encoding: br")))
+			})
+		})
+
+		Context("with compression and a maximum payload size", func() {
+			BeforeEach(func() {
+				options = []InvokerOption{WithMaxPayloadSize(1024)}
+			})
+
+			It("should reject payloads decompressing beyond the maximum size", func() {
+				for _, encoding := range []string{"gzip", "zstd"} {
+					var buffer bytes.Buffer
+					var w io.WriteCloser
+					if encoding == "gzip" {
+						w = gzip.NewWriter(&buffer)
+					} else {
+						w, _ = zstd.NewWriter(&buffer)
+					}
+					w.Write(make([]byte, 1024*1024))
+					w.Close()
+					Expect(buffer.Len()).To(BeNumerically("<", 16*1024))
+
+					stream, err := function.NewMessageFunctionClient(conn).Call(context.Background())
+					Expect(err).NotTo(HaveOccurred())
+					err = stream.Send(msg(buffer.String(), "Content-Encoding", encoding))
+					Expect(err).NotTo(HaveOccurred())
+
+					_, err = stream.Recv()
+					Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+					Expect(err).To(MatchError(ContainSubstring("Decompressed payload exceeds the maximum payload size of 1024 bytes")))
+				}
+			})
+
+			It("should accept payloads decompressing within the maximum size", func() {
+				var buffer bytes.Buffer
+				w := gzip.NewWriter(&buffer)
+				w.Write(bytes.Repeat([]byte("a"), 1000))
+				w.Close()
+				err := sidecar.Send(msg(buffer.String(), "Content-Encoding", "gzip"))
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal(append([]byte("Hello "), bytes.Repeat([]byte("a"), 1000)...)))
+			})
+		})
+
+		Context("with a dead-letter writer", func() {
+			var deadLetters bytes.Buffer
+
+			BeforeEach(func() {
+				deadLetters.Reset()
+				options = []InvokerOption{WithDeadLetterWriter(&deadLetters)}
+			})
+
+			It("should dead-letter messages that fail invocation", func() {
+				err := sidecar.Send(msg("Riff", "Content-Type", "text/plain", "correlationId", "42"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = sidecar.Recv()
+				Expect(err).To(MatchError(io.EOF))
+
+				var letter function.Message
+				Expect(json.Unmarshal(deadLetters.Bytes(), &letter)).To(Succeed())
+				Expect(letter.Payload).To(Equal([]byte("Riff")))
+				Expect(letter.Headers["correlationId"].Values).To(Equal([]string{"42"}))
+				Expect(letter.Headers[Error].Values).To(Equal([]string{"error-server-function-invocation"}))
+				Expect(letter.Headers[ErrorCause].Values[0]).To(ContainSubstring("error condition"))
+				Expect(letter.Headers[Attempts].Values).To(Equal([]string{"1"}))
+				_, err = time.Parse(time.RFC3339Nano, letter.Headers[ErrorTimestamp].Values[0])
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+
+		It("should refuse a dead-letter output that clashes with the function output", func() {
+			_, err := NewInvoker(fmt.Sprintf("%s?%s=%s", builtPlugin, Handler, handler), WithDeadLetterOutput(0))
+			Expect(err).To(MatchError("dead-letter output #0 clashes with the 1 output(s) of the function"))
+		})
+
+		It("should reject unknown charsets", func() {
+			err := sidecar.Send(msg("world", "Content-Type", "text/plain; charset=klingon", "Accept", "text/plain"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = sidecar.Recv()
+			Expect(err).To(MatchError(ContainSubstring("Unsupported Content-Type: text/plain; charset=klingon")))
+		})
+	})
+
+	Context("with 'streaming' functions that accept a string", func() {
+		BeforeEach(func() {
+			handler = "RunLengthEncode"
+		})
+
+		It("should cope with independent input/output streams", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg("hello", "Content-Type", "text/plain", "Accept", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+
+				err = sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte(`{"Word":"world","Count":2}` + "\n")))
+
+			result, err = sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte(`{"Word":"hello","Count":1}` + "\n")))
+
+			result, err = sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte(`{"Word":"world","Count":1}` + "\n")))
+
+			result, err = sidecar.Recv()
+			Expect(err).To(MatchError(io.EOF))
+		})
+
+		Context("with a dead-letter output", func() {
+			BeforeEach(func() {
+				options = []InvokerOption{WithDeadLetterOutput(1)}
+			})
+
+			It("should dead-letter messages that fail unmarshalling, and keep processing", func() {
+				err := sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg("???", "Content-Type", "text/foobar"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg("hello", "Content-Type", "text/plain"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte("???")))
+				Expect(result.Headers[Output].Values).To(Equal([]string{"1"}))
+				Expect(result.Headers[ContentType].Values).To(Equal([]string{"text/foobar"}))
+				Expect(result.Headers[Error].Values).To(Equal([]string{"error-client-content-type-unsupported"}))
+				Expect(result.Headers[ErrorCause].Values).To(Equal([]string{"Unsupported Content-Type: text/foobar"}))
+
+				result, err = sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Headers).NotTo(HaveKey(Output))
+				Expect(result.Payload).To(Equal([]byte(`{"Word":"world","Count":1}` + "\n")))
+
+				result, err = sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte(`{"Word":"hello","Count":1}` + "\n")))
+
+				_, err = sidecar.Recv()
+				Expect(err).To(MatchError(io.EOF))
+			})
+		})
+
+		It("should negotiate xml", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := sidecar.Send(msg("riff", "Content-Type", "text/plain", "Accept", "application/xml"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte("<RLE><Word>riff</Word><Count>1</Count></RLE>")))
+		})
+
+		It("should negotiate binary formats", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := sidecar.Send(msg("riff", "Content-Type", "text/plain", "Accept", "application/cbor;q=0.5, application/msgpack"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Headers[ContentType].Values).To(Equal([]string{"application/msgpack"}))
+			Expect(result.Payload).To(Equal(append([]byte{0x82, 0xa5}, "Count\x01\xa4Word\xa4riff"...)))
+		})
+
+		It("should follow the Accept header of the most recent message", func() {
+			err := sidecar.Send(msg("hello", "Content-Type", "text/plain", "Accept", "application/json"))
+			Expect(err).NotTo(HaveOccurred())
+			err = sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "application/json"))
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Headers[ContentType].Values).To(Equal([]string{"application/json"}))
+			Expect(result.Payload).To(Equal([]byte(`{"Word":"hello","Count":1}` + "\n")))
+
+			err = sidecar.Send(msg("riff", "Content-Type", "text/plain", "Accept", "application/xml"))
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err = sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Headers[ContentType].Values).To(Equal([]string{"application/xml"}))
+			Expect(result.Payload).To(Equal([]byte("<RLE><Word>world</Word><Count>1</Count></RLE>")))
+
+			err = sidecar.Send(msg("riff", "Content-Type", "text/plain"))
+			Expect(err).NotTo(HaveOccurred())
+			err = sidecar.CloseSend()
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err = sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Headers[ContentType].Values).To(Equal([]string{"application/xml"}))
+			Expect(result.Payload).To(Equal([]byte("<RLE><Word>riff</Word><Count>2</Count></RLE>")))
+		})
+
+		It("should propagate user function errors back", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := sidecar.Send(msg("hello", "Content-Type", "text/plain", "Accept", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+
+				err = sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte(`{"Word":"hello","Count":1}` + "\n")))
+
+			result, err = sidecar.Recv()
+			Expect(err).To(MatchError(ContainSubstring("Too many occurrences of world")))
+		})
+
+	})
+	Context("with 'streaming' functions that accept records", func() {
+		BeforeEach(func() {
+			handler = "Invoice"
+		})
+
+		It("should expand csv rows into several inputs", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := sidecar.Send(msg("name,QTY,price\napple,2,0.5\npear,1,0.8\n", "Content-Type", "text/csv", "Accept", "text/plain"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg(`{"Name":"plum","Quantity":3}`+"\n"+`{"Name":"fig"}`, "Content-Type", "application/x-ndjson", "Accept", "text/plain"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			for _, expected := range []string{"2 apple", "1 pear", "3 plum", "0 fig"} {
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte(expected)))
+			}
+
+			_, err := sidecar.Recv()
+			Expect(err).To(MatchError(io.EOF))
+		})
+
+		Context("in strict json mode", func() {
+			BeforeEach(func() {
+				options = []InvokerOption{WithStrictJSON(true, false)}
+			})
+
+			It("should reject unknown fields", func() {
+				err := sidecar.Send(msg(`{"Name":"fig","Qty":1}`, "Content-Type", "application/json", "Accept", "text/plain"))
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = sidecar.Recv()
+				Expect(err).To(MatchError(ContainSubstring(`unknown field "Qty"`)))
+			})
+		})
+
+		It("should report invalid records", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := sidecar.Send(msg("name,qty\napple,many\n", "Content-Type", "text/csv", "Accept", "text/plain"))
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			_, err := sidecar.Recv()
+			Expect(err).To(MatchError(ContainSubstring("record #0, column qty")))
+		})
+	})
+
+	Context("with 'streaming' functions that have several inputs and outputs", func() {
+		BeforeEach(func() {
+			handler = "Join"
+			options = []InvokerOption{WithStreamNames([]string{"words", "counts"}, []string{"evens", "odds"})}
+		})
+
+		It("should route messages to inputs by name or index, and tag outputs", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := sidecar.Send(msg("ab", "Content-Type", "text/plain", "Accept", "text/plain", Input, "words"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg("2", "Content-Type", "text/plain", Input, "1"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg("c", "Content-Type", "text/plain"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg("3", "Content-Type", "text/plain", Input, "counts"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte("abab")))
+			Expect(result.Headers[Output].Values).To(Equal([]string{"evens"}))
+
+			result, err = sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte("ccc")))
+			Expect(result.Headers[Output].Values).To(Equal([]string{"odds"}))
+
+			_, err = sidecar.Recv()
+			Expect(err).To(MatchError(io.EOF))
+		})
+
+		It("should not deadlock when inputs interleave differently than the function reads them", func() {
+			go func() {
+				defer GinkgoRecover()
+				for _, m := range []*function.Message{
+					msg("a", "Content-Type", "text/plain", Input, "words"),
+					msg("b", "Content-Type", "text/plain", Input, "words"),
+					msg("c", "Content-Type", "text/plain", Input, "words"),
+					msg("1", "Content-Type", "text/plain", Input, "counts"),
+					msg("2", "Content-Type", "text/plain", Input, "counts"),
+					msg("3", "Content-Type", "text/plain", Input, "counts"),
+				} {
+					err := sidecar.Send(m)
+					Expect(err).NotTo(HaveOccurred())
+				}
+				err := sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			var payloads []string
+			for i := 0; i < 3; i++ {
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				payloads = append(payloads, string(result.Payload))
+			}
+			Expect(payloads).To(Equal([]string{"a", "bb", "ccc"}))
+
+			_, err := sidecar.Recv()
+			Expect(err).To(MatchError(io.EOF))
+		})
+
+		It("should reject unknown inputs", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := sidecar.Send(msg("ab", "Content-Type", "text/plain", Input, "2"))
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			_, err := sidecar.Recv()
+			Expect(err).To(MatchError(ContainSubstring("Unknown input: 2")))
+		})
+	})
+
+	Context("with Supplier-style functions", func() {
+		BeforeEach(func() {
+			handler = "SupplierFunc"
+		})
+
+		It("should support supplier-style functions", func() {
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte("0")))
+
+			result, err = sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte("1")))
+
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				err = sidecar.CloseSend()
+
+			}()
+
+			Eventually(func() error {
+				_, err := sidecar.Recv()
+				return err
+			}, 1*time.Second, 10*time.Millisecond).Should(MatchError(io.EOF))
+
+		})
+
+	})
+
+	Context("with lifecycle hooks", func() {
+		BeforeEach(func() {
+			handler = "Greet"
+			query = "&greeting=Howdy"
+		})
+
+		It("should pass function URI parameters to Init", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "text/plain"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte("Howdy world")))
+		})
+
+		It("should report Init errors", func() {
+			other, err := NewInvoker(fmt.Sprintf("%s?%s=%s&greeting=", builtPlugin, Handler, handler))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(other.Init()).To(MatchError("greeting should not be empty"))
+		})
+	})
+
+	Context("with an exported Config struct", func() {
+		BeforeEach(func() {
+			handler = "Shout"
+			query = "&punctuation=?&repeat=1"
+			options = []InvokerOption{WithConfig(map[string]string{"punctuation": "!", "repeat": "2"})}
+		})
+
+		It("should fill the struct before invocation, favoring explicit configuration", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "text/plain"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte("WORLD!WORLD!")))
+		})
+
+		It("should fail Init for invalid values", func() {
+			other, err := NewInvoker(fmt.Sprintf("%s?%s=%s&repeat=many", builtPlugin, Handler, handler))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(other.Init()).To(MatchError(ContainSubstring("invalid value for configuration key repeat")))
+		})
+	})
+
+	Context("with batching functions", func() {
+		BeforeEach(func() {
+			handler = "Tally"
+			options = []InvokerOption{WithBatching(2, 200*time.Millisecond)}
+		})
+
+		It("should invoke the function with batches", func() {
+			go func() {
+				defer GinkgoRecover()
+				for _, s := range []string{"a", "b", "c"} {
+					err := sidecar.Send(msg(s, "Content-Type", "text/plain", "Accept", "text/plain"))
+					Expect(err).NotTo(HaveOccurred())
+				}
+				err := sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte("2")))
+
+			result, err = sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte("1")))
+
+			_, err = sidecar.Recv()
+			Expect(err).To(MatchError(io.EOF))
+		})
+
+		It("should not wait longer than the max wait time", func() {
+			err := sidecar.Send(msg("a", "Content-Type", "text/plain", "Accept", "text/plain"))
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte("1")))
+		})
+
+		It("should report which batch caused an error", func() {
+			go func() {
+				defer GinkgoRecover()
+				for _, s := range []string{"a", "b", "c", "Riff"} {
+					err := sidecar.Send(msg(s, "Content-Type", "text/plain", "Accept", "text/plain"))
+					Expect(err).NotTo(HaveOccurred())
+				}
+			}()
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte("2")))
+
+			_, err = sidecar.Recv()
+			Expect(err).To(MatchError(ContainSubstring("batch of messages #2 to #3: Riff is not welcome")))
+		})
+
+		Context("with a dead-letter output", func() {
+			BeforeEach(func() {
+				options = append(options, WithDeadLetterOutput(1))
+			})
+
+			It("should dead-letter each message of a failed batch, and keep processing", func() {
+				go func() {
+					defer GinkgoRecover()
+					for _, s := range []string{"a", "b", "c", "Riff", "d"} {
+						err := sidecar.Send(msg(s, "Content-Type", "text/plain", "Accept", "text/plain"))
+						Expect(err).NotTo(HaveOccurred())
+					}
+					err := sidecar.CloseSend()
+					Expect(err).NotTo(HaveOccurred())
+				}()
+
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte("2")))
+
+				for _, expected := range []string{"c", "Riff"} {
+					result, err = sidecar.Recv()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(result.Payload).To(Equal([]byte(expected)))
+					Expect(result.Headers[Output].Values).To(Equal([]string{"1"}))
+					Expect(result.Headers[Error].Values).To(Equal([]string{"error-server-function-invocation"}))
+					Expect(result.Headers[ErrorCause].Values).To(Equal([]string{"batch of messages #2 to #3: Riff is not welcome"}))
+				}
+
+				result, err = sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Headers).NotTo(HaveKey(Output))
+				Expect(result.Payload).To(Equal([]byte("1")))
+
+				_, err = sidecar.Recv()
+				Expect(err).To(MatchError(io.EOF))
+			})
+		})
+
+		Context("that are not listed as batched", func() {
+			BeforeEach(func() {
+				handler = "Count"
+			})
+
+			It("should pass them the whole slice", func() {
+				err := sidecar.Send(msg(`["a","b","c"]`, "Content-Type", "application/json", "Accept", "text/plain"))
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte("3")))
+			})
+		})
+	})
+
+	Context("with retries", func() {
+		BeforeEach(func() {
+			handler = "Flaky"
+			options = []InvokerOption{WithRetries(3, time.Millisecond, 5*time.Millisecond)}
+		})
+
+		It("should invoke the function again after transient errors", func() {
+			retries := metric(retriesMetric)
+			err := sidecar.Send(msg("transient:3"))
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte("transient succeeded after 3 attempts")))
+			Expect(result.Headers[Attempts].Values).To(Equal([]string{"3"}))
+			Expect(metric(retriesMetric) - retries).To(Equal(int64(2)))
+		})
+
+		It("should give up after the maximum number of attempts", func() {
+			exhausted := metric(retriesExhaustedMetric)
+			err := sidecar.Send(msg("persistent:5"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = sidecar.Recv()
+			Expect(err).To(MatchError(ContainSubstring("attempt #3 failed")))
+			Expect(metric(retriesExhaustedMetric) - exhausted).To(Equal(int64(1)))
+		})
+
+		It("should not retry permanent errors", func() {
+			retries, permanent := metric(retriesMetric), metric(permanentErrorsMetric)
+			err := sidecar.Send(msg("malformed"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = sidecar.Recv()
+			Expect(err).To(MatchError(ContainSubstring("malformed input malformed")))
+			Expect(metric(retriesMetric)).To(Equal(retries))
+			Expect(metric(permanentErrorsMetric) - permanent).To(Equal(int64(1)))
+		})
+
+		Context("and a function reading its input", func() {
+			BeforeEach(func() {
+				handler = "FlakyReader"
+			})
+
+			It("should not retry, as the input can't be read again", func() {
+				retries := metric(retriesMetric)
+				err := sidecar.Send(msg("reader:2"))
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = sidecar.Recv()
+				Expect(err).To(MatchError(ContainSubstring("attempt #1 failed")))
+				Expect(metric(retriesMetric)).To(Equal(retries))
+			})
+		})
+
+		Context("and a dead-letter writer", func() {
+			var deadLetters bytes.Buffer
+
+			BeforeEach(func() {
+				deadLetters.Reset()
+				options = append(options, WithDeadLetterWriter(&deadLetters))
+			})
+
+			It("should tell the number of attempts", func() {
+				err := sidecar.Send(msg("dead:5"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = sidecar.Recv()
+				Expect(err).To(MatchError(io.EOF))
+
+				var letter function.Message
+				Expect(json.Unmarshal(deadLetters.Bytes(), &letter)).To(Succeed())
+				Expect(letter.Headers[Attempts].Values).To(Equal([]string{"3"}))
+				Expect(letter.Headers[ErrorCause].Values).To(Equal([]string{"attempt #3 failed"}))
+			})
+		})
+	})
+
+	Context("with limits", func() {
+		Context("on the rate of messages", func() {
+			BeforeEach(func() {
+				handler = "RunLengthEncode"
+				options = []InvokerOption{WithRateLimits(1, 0), WithLimitRejection()}
+			})
+
+			It("should reject messages over the limit", func() {
+				err := sidecar.Send(msg("hello", "Content-Type", "text/plain", "Accept", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+
+				for err == nil {
+					_, err = sidecar.Recv()
+				}
+				Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+				Expect(err).To(MatchError(ContainSubstring("Rate limit exceeded")))
+			})
+		})
+
+		Context("on the rate of messages, with a dead-letter output", func() {
+			BeforeEach(func() {
+				handler = "StringInStringOut"
+				options = []InvokerOption{WithRateLimits(1, 0), WithLimitRejection(), WithDeadLetterOutput(1)}
+			})
+
+			It("should dead-letter messages over the limit, and keep processing", func() {
+				err := sidecar.Send(msg("hello"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg("world"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+
+				var results []*function.Message
+				for {
+					result, err := sidecar.Recv()
+					if err == io.EOF {
+						break
+					}
+					Expect(err).NotTo(HaveOccurred())
+					results = append(results, result)
+				}
+				Expect(results).To(HaveLen(2))
+				for _, result := range results {
+					if result.Headers[Output] != nil {
+						Expect(result.Payload).To(Equal([]byte("world")))
+						Expect(result.Headers[Error].Values).To(Equal([]string{"error-client-rate-limit-exceeded"}))
+					} else {
+						Expect(result.Payload).To(Equal([]byte("Hello hello")))
+					}
+				}
+			})
+		})
+
+		Context("on concurrent streams", func() {
+			BeforeEach(func() {
+				handler = "StringInStringOut"
+				options = []InvokerOption{WithConcurrencyLimits(1, 0), WithLimitRejection()}
+			})
+
+			It("should reject streams over the limit", func() {
+				err := sidecar.Send(msg("world"))
+				Expect(err).NotTo(HaveOccurred())
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte("Hello world")))
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				other, err := function.NewMessageFunctionClient(conn).Call(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				err = other.Send(msg("riff"))
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = other.Recv()
+				Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+				Expect(err).To(MatchError(ContainSubstring("Too many concurrent streams")))
+			})
+		})
+	})
+
+	Context("with an idle timeout", func() {
+		BeforeEach(func() {
+			handler = "RunLengthEncode"
+			options = []InvokerOption{WithIdleTimeout(200 * time.Millisecond)}
+		})
+
+		It("should end input once no message arrived for that long", func() {
+			err := sidecar.Send(msg("riff", "Accept", "application/json"))
+			Expect(err).NotTo(HaveOccurred())
+			err = sidecar.Send(msg("riff", "Accept", "application/json"))
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(MatchJSON(`{"Word":"riff","Count":2}`))
+			_, err = sidecar.Recv()
+			Expect(err).To(MatchError(io.EOF))
+		})
+
+		It("should wait again after each message", func() {
+			start := time.Now()
+			for _, word := range []string{"one", "two", "three"} {
+				err := sidecar.Send(msg(word, "Accept", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+				time.Sleep(150 * time.Millisecond)
+			}
+
+			var words []string
+			for {
+				result, err := sidecar.Recv()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).NotTo(HaveOccurred())
+				var rle map[string]interface{}
+				Expect(json.Unmarshal(result.Payload, &rle)).To(Succeed())
+				words = append(words, rle["Word"].(string))
+			}
+			Expect(words).To(Equal([]string{"one", "two", "three"}))
+			Expect(time.Since(start)).To(BeNumerically(">=", 450*time.Millisecond))
+		})
+	})
+
+	Context("with functions that never close their outputs", func() {
+		var warnings *gbytes.Buffer
+
+		BeforeEach(func() {
+			handler = "Stubborn"
+			options = []InvokerOption{WithLeakGracePeriod(100 * time.Millisecond)}
+			warnings = gbytes.NewBuffer()
+			Warning.SetOutput(warnings)
+		})
+
+		AfterEach(func() {
+			Warning.SetOutput(os.Stderr)
+		})
+
+		It("should abandon them after a grace period", func() {
+			leaks := metric(leakedFunctionsMetric)
+			err := sidecar.Send(msg("riff"))
+			Expect(err).NotTo(HaveOccurred())
+			result, err := sidecar.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Payload).To(Equal([]byte("riff")))
+
+			err = sidecar.CloseSend()
+			Expect(err).NotTo(HaveOccurred())
+			_, err = sidecar.Recv()
+			Expect(status.Code(err)).To(Equal(codes.Internal))
+			Expect(err).To(MatchError(ContainSubstring("Function did not close its outputs within 100ms of its input closing")))
+
+			Expect(warnings).To(gbytes.Say("Function Stubborn did not close its outputs"))
+			Expect(warnings).To(gbytes.Say("goroutine \\d+"))
+			Expect(metric(leakedFunctionsMetric) - leaks).To(Equal(int64(1)))
+		})
+
+		It("should not dump goroutines for streams that already failed", func() {
+			err := sidecar.Send(msg("riff", Input, "2"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = sidecar.Recv()
+			Expect(err).To(MatchError(ContainSubstring("Unknown input: 2")))
+
+			Eventually(warnings).Should(gbytes.Say("Function Stubborn did not close its outputs within 100ms of its input closing, after the stream failed"))
+			Expect(warnings.Contents()).NotTo(ContainSubstring("goroutine "))
+		})
+
+		Context("when 'direct'", func() {
+			BeforeEach(func() {
+				handler = "Unfinished"
+			})
+
+			It("should release the goroutines feeding their outputs", func() {
+				err := sidecar.Send(msg("riff"))
+				Expect(err).NotTo(HaveOccurred())
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte("riff")))
+				Expect(string(goroutineDump())).To(ContainSubstring("server.sendElements"))
+
+				err = sidecar.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+				_, err = sidecar.Recv()
+				Expect(err).To(MatchError(ContainSubstring("Function did not close its outputs within 100ms of its input closing")))
+				Eventually(func() string { return string(goroutineDump()) }).ShouldNot(ContainSubstring("server.sendElements"))
+			})
+		})
+
+		It("should only be detected if asked to", func() {
+			Expect(DefaultLeakGracePeriod).To(BeZero())
+		})
+	})
+
+	Context("with message size limits", func() {
+		BeforeEach(func() {
+			handler = "StringInStringOut"
+			options = []InvokerOption{WithMaxSendSize(32)}
+		})
+
+		It("should reject outputs over the maximum size", func() {
+			err := sidecar.Send(msg("a rather lengthy input, for a small maximum size"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = sidecar.Recv()
+			Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+			Expect(err).To(MatchError(ContainSubstring("exceeds the maximum message size of 32 bytes")))
+		})
+	})
+
+	Context("with chunking", func() {
+		BeforeEach(func() {
+			options = []InvokerOption{WithChunking(4)}
+		})
+
+		// recvPayload reassembles the payload of the chunks received in a row, checking their sequence headers
+		recvPayload := func() string {
+			var payload []byte
+			for i := 0; ; i++ {
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Headers[ChunkIndex].Values).To(Equal([]string{strconv.Itoa(i)}))
+				payload = append(payload, result.Payload...)
+				if result.Headers[ChunkLast] != nil {
+					Expect(result.Headers[ChunkLast].Values).To(Equal([]string{"true"}))
+					return string(payload)
+				}
+			}
+		}
+
+		Context("with functions accepting an io.Reader", func() {
+			BeforeEach(func() {
+				handler = "Echo"
+			})
+
+			It("should stream chunks to the function, and split large outputs", func() {
+				err := sidecar.Send(msg("hello ", ChunkIndex, "0"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg("chunked ", ChunkIndex, "1"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.Send(msg("world", ChunkIndex, "2", ChunkLast, "true"))
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(recvPayload()).To(Equal("hello chunked world"))
+			})
 
-			err = sidecar.CloseSend()
-			Expect(err).NotTo(HaveOccurred())
-			result, err = sidecar.Recv()
-			Expect(err).To(MatchError(io.EOF))
-		})
+			It("should decode compressed chunks", func() {
+				var buffer bytes.Buffer
+				w := gzip.NewWriter(&buffer)
+				w.Write([]byte("compressed"))
+				w.Close()
+				compressed := buffer.String()
 
-		It("idiomatic go errors are propagated back", func() {
-			go func() {
-				defer GinkgoRecover()
-				err := sidecar.Send(msg("Riff", "Content-Type", "text/plain", "Accept", "text/plain"))
+				err := sidecar.Send(msg(compressed[:5], ChunkIndex, "0", "Content-Encoding", "gzip"))
 				Expect(err).NotTo(HaveOccurred())
-				err = sidecar.CloseSend()
+				err = sidecar.Send(msg(compressed[5:], ChunkIndex, "1", ChunkLast, "true", "Content-Encoding", "gzip"))
 				Expect(err).NotTo(HaveOccurred())
-			}()
 
-			_, err := sidecar.Recv()
-			Expect(err).To(MatchError(ContainSubstring("error condition")))
+				Expect(recvPayload()).To(Equal("compressed"))
+			})
 
-		})
+			It("should accept unchunked messages", func() {
+				err := sidecar.Send(msg("riff"))
+				Expect(err).NotTo(HaveOccurred())
 
-		It("unmarshalling errors abort and are propagated", func() {
-			go func() {
-				defer GinkgoRecover()
-				err := sidecar.Send(msg("world", "Content-Type", "text/foobar", "Accept", "text/plain"))
+				result, err := sidecar.Recv()
 				Expect(err).NotTo(HaveOccurred())
-			}()
+				Expect(result.Payload).To(Equal([]byte("riff")))
+				Expect(result.Headers).NotTo(HaveKey(ChunkIndex))
+			})
 
-			_, err := sidecar.Recv()
-			Expect(err).To(MatchError(ContainSubstring("Unsupported Content-Type: text/foobar")))
-		})
+			Context("with a maximum payload size", func() {
+				BeforeEach(func() {
+					options = append(options, WithMaxPayloadSize(10))
+				})
+
+				It("should fail the reader once the payload grows too large", func() {
+					var err error
+					for i := 0; err == nil && i < 100; i++ {
+						err = sidecar.Send(msg("chunk", ChunkIndex, strconv.Itoa(i)))
+					}
+
+					_, err = sidecar.Recv()
+					Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+					Expect(err).To(MatchError(ContainSubstring("Chunked payload exceeds the maximum payload size of 10 bytes")))
+				})
+			})
 
-		It("marshalling errors abort and are propagated", func() {
-			go func() {
-				defer GinkgoRecover()
-				err := sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "text/foobar"))
+			It("should report input ending in the middle of a payload", func() {
+				err := sidecar.Send(msg("hello ", ChunkIndex, "0"))
+				Expect(err).NotTo(HaveOccurred())
+				err = sidecar.CloseSend()
 				Expect(err).NotTo(HaveOccurred())
-			}()
 
-			_, err := sidecar.Recv()
-			Expect(err).To(MatchError(ContainSubstring("unsupported content types: [text/foobar]")))
+				_, err = sidecar.Recv()
+				Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+				Expect(err).To(MatchError(ContainSubstring("Input ended in the middle of a chunked payload")))
+			})
 		})
-	})
 
-	Context("with 'streaming' functions that accept a string", func() {
-		BeforeEach(func() {
-			handler = "RunLengthEncode"
-		})
+		Context("with other functions", func() {
+			BeforeEach(func() {
+				handler = "StringInStringOut"
+			})
 
-		It("should cope with independent input/output streams", func() {
-			go func() {
-				defer GinkgoRecover()
-				err := sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "application/json"))
+			It("should reassemble chunks before unmarshalling", func() {
+				err := sidecar.Send(msg("chunked ", ChunkIndex, "0", "Content-Type", "text/plain"))
 				Expect(err).NotTo(HaveOccurred())
-				err = sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "application/json"))
+				err = sidecar.Send(msg("world", ChunkIndex, "1", ChunkLast, "true", "Content-Type", "text/plain"))
 				Expect(err).NotTo(HaveOccurred())
-				err = sidecar.Send(msg("hello", "Content-Type", "text/plain", "Accept", "application/json"))
+
+				Expect(recvPayload()).To(Equal("Hello chunked world"))
+			})
+
+			Context("with a maximum payload size", func() {
+				BeforeEach(func() {
+					options = append(options, WithMaxPayloadSize(10))
+				})
+
+				It("should reject payloads that grow too large without ending", func() {
+					var err error
+					for i := 0; err == nil && i < 100; i++ {
+						err = sidecar.Send(msg("chunk", ChunkIndex, strconv.Itoa(i)))
+					}
+
+					_, err = sidecar.Recv()
+					Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+					Expect(err).To(MatchError(ContainSubstring("Chunked payload exceeds the maximum payload size of 10 bytes")))
+				})
+
+				It("should reject payloads too large once complete", func() {
+					err := sidecar.Send(msg("chunked ", ChunkIndex, "0"))
+					Expect(err).NotTo(HaveOccurred())
+					err = sidecar.Send(msg("world", ChunkIndex, "1", ChunkLast, "true"))
+					Expect(err).NotTo(HaveOccurred())
+
+					_, err = sidecar.Recv()
+					Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+					Expect(err).To(MatchError(ContainSubstring("Chunked payload exceeds the maximum payload size of 10 bytes")))
+				})
+			})
+
+			It("should reject chunks out of sequence", func() {
+				err := sidecar.Send(msg("chunked ", ChunkIndex, "0"))
 				Expect(err).NotTo(HaveOccurred())
-				err = sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "application/json"))
+				err = sidecar.Send(msg("world", ChunkIndex, "2", ChunkLast, "true"))
 				Expect(err).NotTo(HaveOccurred())
 
-				err = sidecar.CloseSend()
-				Expect(err).NotTo(HaveOccurred())
-			}()
+				_, err = sidecar.Recv()
+				Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+				Expect(err).To(MatchError("rpc error: code = FailedPrecondition desc = Unexpected chunk 2 on input #0, expecting chunk 1"))
+			})
+		})
+	})
+
+	Context("with 'direct' functions using text-based types", func() {
+		BeforeEach(func() {
+			handler = "Elapsed"
+		})
+
+		It("should honor TextMarshaler and TextUnmarshaler", func() {
+			err := sidecar.Send(msg("2018-01-01T01:30:00Z", "Content-Type", "text/plain", "Accept", "text/plain"))
+			Expect(err).NotTo(HaveOccurred())
 
 			result, err := sidecar.Recv()
 			Expect(err).NotTo(HaveOccurred())
-			Expect(result.Payload).To(Equal([]byte(`{"Word":"world","Count":2}` + "\n")))
+			Expect(result.Payload).To(Equal([]byte("1h30m0s")))
+		})
 
-			result, err = sidecar.Recv()
+		It("should honor json.Unmarshaler", func() {
+			err := sidecar.Send(msg(`"2018-01-01T00:00:02Z"`, "Content-Type", "application/json", "Accept", "application/json"))
 			Expect(err).NotTo(HaveOccurred())
-			Expect(result.Payload).To(Equal([]byte(`{"Word":"hello","Count":1}` + "\n")))
 
-			result, err = sidecar.Recv()
+			result, err := sidecar.Recv()
 			Expect(err).NotTo(HaveOccurred())
-			Expect(result.Payload).To(Equal([]byte(`{"Word":"world","Count":1}` + "\n")))
+			Expect(result.Payload).To(Equal([]byte("2000000000\n")))
+		})
+	})
 
-			result, err = sidecar.Recv()
-			Expect(err).To(MatchError(io.EOF))
+	Context("with 'direct' functions returning several values", func() {
+		Context("by default", func() {
+			BeforeEach(func() {
+				handler = "Tokenize"
+			})
+
+			It("should send a returned slice as a single message", func() {
+				go func() {
+					defer GinkgoRecover()
+					err := sidecar.Send(msg("hello riff world", "Content-Type", "text/plain", "Accept", "application/json"))
+					Expect(err).NotTo(HaveOccurred())
+					err = sidecar.CloseSend()
+					Expect(err).NotTo(HaveOccurred())
+				}()
+
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte(`["hello","riff","world"]` + "\n")))
+			})
 		})
 
-		It("should propagate user function errors back", func() {
-			go func() {
-				defer GinkgoRecover()
-				err := sidecar.Send(msg("hello", "Content-Type", "text/plain", "Accept", "application/json"))
+		Context("when asking for records", func() {
+			BeforeEach(func() {
+				handler = "Tokenize"
+			})
+
+			It("should aggregate the elements in a single message", func() {
+				err := sidecar.Send(msg("hello riff", "Content-Type", "text/plain", "Accept", "application/x-ndjson"))
 				Expect(err).NotTo(HaveOccurred())
-				err = sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "application/json"))
+
+				result, err := sidecar.Recv()
 				Expect(err).NotTo(HaveOccurred())
-				err = sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "application/json"))
+				Expect(result.Payload).To(Equal([]byte("\"hello\"\n\"riff\"\n")))
+			})
+		})
+
+		Context("when returning nil", func() {
+			BeforeEach(func() {
+				handler = "Nothing"
+			})
+
+			It("should marshall it as a null record", func() {
+				err := sidecar.Send(msg("riff", "Accept", "text/csv, application/x-ndjson;q=0.5"))
 				Expect(err).NotTo(HaveOccurred())
-				err = sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "application/json"))
+
+				result, err := sidecar.Recv()
 				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte("null\n")))
+			})
 
-				err = sidecar.CloseSend()
+			It("should report records that can't be marshalled", func() {
+				err := sidecar.Send(msg("riff", "Accept", "text/csv"))
 				Expect(err).NotTo(HaveOccurred())
-			}()
 
-			result, err := sidecar.Recv()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(result.Payload).To(Equal([]byte(`{"Word":"hello","Count":1}` + "\n")))
+				_, err = sidecar.Recv()
+				Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+				Expect(err).To(MatchError(ContainSubstring("unsupported content types: [text/csv]")))
+			})
+		})
 
-			result, err = sidecar.Recv()
-			Expect(err).To(MatchError(ContainSubstring("Too many occurrences of world")))
+		Context("when splitting slices", func() {
+			BeforeEach(func() {
+				handler = "Tokenize"
+				options = []InvokerOption{WithSplitting()}
+			})
+
+			It("should send each element as its own message", func() {
+				go func() {
+					defer GinkgoRecover()
+					err := sidecar.Send(msg("hello riff world", "Content-Type", "text/plain", "Accept", "text/plain"))
+					Expect(err).NotTo(HaveOccurred())
+					err = sidecar.CloseSend()
+					Expect(err).NotTo(HaveOccurred())
+				}()
+
+				for _, w := range []string{"hello", "riff", "world"} {
+					result, err := sidecar.Recv()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(result.Payload).To(Equal([]byte(w)))
+				}
+				_, err := sidecar.Recv()
+				Expect(err).To(MatchError(io.EOF))
+			})
 		})
 
+		Context("when returning a channel", func() {
+			BeforeEach(func() {
+				handler = "Spell"
+			})
+
+			It("should send each element as its own message", func() {
+				go func() {
+					defer GinkgoRecover()
+					err := sidecar.Send(msg("riff", "Content-Type", "text/plain", "Accept", "text/plain"))
+					Expect(err).NotTo(HaveOccurred())
+					err = sidecar.CloseSend()
+					Expect(err).NotTo(HaveOccurred())
+				}()
+
+				for _, l := range []string{"r", "i", "f", "f"} {
+					result, err := sidecar.Recv()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(result.Payload).To(Equal([]byte(l)))
+				}
+				_, err := sidecar.Recv()
+				Expect(err).To(MatchError(io.EOF))
+			})
+		})
 	})
-	Context("with Supplier-style functions", func() {
-		BeforeEach(func() {
-			handler = "SupplierFunc"
+
+	Context("with CloudEvents", func() {
+		Context("with a function accepting a plain value", func() {
+			BeforeEach(func() {
+				handler = "StringInStringOut"
+			})
+
+			It("should pass the data of binary mode events", func() {
+				go func() {
+					defer GinkgoRecover()
+					err := sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "text/plain",
+						"ce-specversion", "1.0", "ce-id", "42", "ce-source", "/test", "ce-type", "test"))
+					Expect(err).NotTo(HaveOccurred())
+				}()
+
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte("Hello world")))
+			})
+
+			It("should reply in structured mode when asked to", func() {
+				go func() {
+					defer GinkgoRecover()
+					err := sidecar.Send(msg(`{"specversion":"1.0","id":"42","source":"/test","type":"test","datacontenttype":"text/plain","data":"world"}`,
+						"Content-Type", "application/cloudevents+json", "Accept", "application/cloudevents+json, text/plain"))
+					Expect(err).NotTo(HaveOccurred())
+				}()
+
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Headers[ContentType].Values).To(Equal([]string{"application/cloudevents+json"}))
+				Expect(string(result.Payload)).To(ContainSubstring(`"data":"Hello world"`))
+				Expect(string(result.Payload)).To(ContainSubstring(`"datacontenttype":"text/plain"`))
+				Expect(string(result.Payload)).To(ContainSubstring(`"source":"go-function-invoker"`))
+			})
 		})
 
-		It("should support supplier-style functions", func() {
-			result, err := sidecar.Recv()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(result.Payload).To(Equal([]byte("0")))
+		Context("with outputs wrapped as CloudEvents", func() {
+			BeforeEach(func() {
+				handler = "StringInStringOut"
+				options = []InvokerOption{WithCloudEvents("/greeter", "greeting")}
+			})
 
-			result, err = sidecar.Recv()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(result.Payload).To(Equal([]byte("1")))
+			It("should reply in binary mode by default, generating ids", func() {
+				go func() {
+					defer GinkgoRecover()
+					err := sidecar.Send(msg("world", "Content-Type", "text/plain", "Accept", "text/plain"))
+					Expect(err).NotTo(HaveOccurred())
+				}()
 
-			go func() {
-				time.Sleep(100 * time.Millisecond)
-				err = sidecar.CloseSend()
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte("Hello world")))
+				Expect(result.Headers["ce-source"].Values).To(Equal([]string{"/greeter"}))
+				Expect(result.Headers["ce-type"].Values).To(Equal([]string{"greeting"}))
+				Expect(result.Headers["ce-specversion"].Values).To(Equal([]string{"1.0"}))
+				Expect(result.Headers["ce-id"].Values[0]).To(MatchRegexp("^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$"))
+			})
+		})
 
-			}()
+		Context("with a function accepting an envelope", func() {
+			BeforeEach(func() {
+				handler = "DescribeEvent"
+			})
 
-			Eventually(func() error {
-				_, err := sidecar.Recv()
-				return err
-			}, 1*time.Second, 10*time.Millisecond).Should(MatchError(io.EOF))
+			It("should fill the envelope from structured mode events", func() {
+				go func() {
+					defer GinkgoRecover()
+					err := sidecar.Send(msg(`{"specversion":"1.0","id":"42","source":"/test","type":"rle","data":{"Word":"riff","Count":3}}`,
+						"Content-Type", "application/cloudevents+json", "Accept", "text/plain"))
+					Expect(err).NotTo(HaveOccurred())
+				}()
+
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte("rle 42 from /test: riff x3")))
+			})
+
+			It("should fill the envelope from binary mode events", func() {
+				go func() {
+					defer GinkgoRecover()
+					err := sidecar.Send(msg(`{"Word":"riff","Count":3}`, "Content-Type", "application/json", "Accept", "text/plain",
+						"ce-specversion", "1.0", "ce-id", "42", "ce-source", "/test", "ce-type", "rle"))
+					Expect(err).NotTo(HaveOccurred())
+				}()
+
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte("rle 42 from /test: riff x3")))
+			})
+		})
+
+		Context("with a function accepting an envelope of any data", func() {
+			BeforeEach(func() {
+				handler = "DescribeAnyEvent"
+			})
+
+			It("should leave the data zero for null data", func() {
+				go func() {
+					defer GinkgoRecover()
+					err := sidecar.Send(msg(`null`, "Content-Type", "application/json", "Accept", "text/plain",
+						"ce-specversion", "1.0", "ce-id", "42", "ce-source", "/test", "ce-type", "nothing"))
+					Expect(err).NotTo(HaveOccurred())
+				}()
 
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte("nothing: <nil>")))
+			})
 		})
 
+		Context("with a function returning an envelope", func() {
+			BeforeEach(func() {
+				handler = "Acknowledge"
+			})
+
+			It("should favor the attributes of the envelope", func() {
+				go func() {
+					defer GinkgoRecover()
+					err := sidecar.Send(msg(`{"Word":"riff","Count":3}`, "Content-Type", "application/json", "Accept", "application/json"))
+					Expect(err).NotTo(HaveOccurred())
+				}()
+
+				result, err := sidecar.Recv()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Payload).To(Equal([]byte(`{"Word":"riff","Count":3}` + "\n")))
+				Expect(result.Headers["ce-type"].Values).To(Equal([]string{"ack"}))
+				Expect(result.Headers["ce-source"].Values).To(Equal([]string{DefaultCloudEventSource}))
+			})
+		})
 	})
 
 	Context("with 'direct' style functions", func() {
@@ -490,6 +1896,14 @@ func msg(payload string, headers ... string) *function.Message {
 
 }
 
+// metric returns the current value of the given invoker counter
+func metric(name string) int64 {
+	if v, ok := metrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
 func sourceOf(lib string) string {
 	result := []rune(lib)
 	result[len(lib)-len("so")] = 'g'
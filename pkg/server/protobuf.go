@@ -0,0 +1,79 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const ProtobufContentType = MediaType("application/x-protobuf")
+
+var protoMessageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+// protobufMarshalling supports both marshalling and unmarshalling to/from the protocol buffers binary format, for
+// types generated by protoc-gen-go (that is, implementing proto.Message, typically with a pointer receiver).
+type protobufMarshalling struct {
+}
+
+func (*protobufMarshalling) supportedMediaTypes(t reflect.Type) []MediaType {
+	if t == nil || !implements(t, protoMessageType) {
+		return nil
+	}
+	return []MediaType{ProtobufContentType, "application/protobuf"}
+}
+
+func (*protobufMarshalling) marshall(value interface{}, w io.Writer, mediaType MediaType) error {
+	b, err := proto.Marshal(withMethods(value, protoMessageType).(proto.Message))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (*protobufMarshalling) canUnmarshall(t reflect.Type, mediaType MediaType) bool {
+	contentType, _, err := mime.ParseMediaType(string(mediaType))
+	if err != nil {
+		return false
+	}
+	return (contentType == string(ProtobufContentType) || contentType == "application/protobuf") &&
+		implements(t, protoMessageType)
+}
+
+func (*protobufMarshalling) unmarshall(r io.Reader, t reflect.Type, mediaType MediaType) (interface{}, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if t.Kind() == reflect.Ptr { // the usual case of generated messages
+		data := reflect.New(t.Elem()).Interface()
+		if err = proto.Unmarshal(b, data.(proto.Message)); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	ptrToData := reflect.New(t)
+	if err = proto.Unmarshal(b, ptrToData.Interface().(proto.Message)); err != nil {
+		return nil, err
+	}
+	return reflect.Indirect(ptrToData).Interface(), nil
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"reflect"
+	"strings"
+)
+
+const (
+	NDJSONContentType = MediaType("application/x-ndjson")
+	CSVContentType    = MediaType("text/csv")
+
+	// csvTag is the struct tag used to map a field onto a CSV column, defaulting to the (case insensitive) field name
+	csvTag = "csv"
+)
+
+// records is returned by unmarshallers that expand a single payload into several values, each of which is sent in turn
+// to the function input.
+type records []interface{}
+
+// ndjsonMarshalling supports newline delimited json, where each line is a json value.
+// When unmarshalling, a payload is expanded into one value per line. When marshalling, the elements of a slice are
+// aggregated into one line each, while other values are written as a single line.
+type ndjsonMarshalling struct {
+}
+
+func (*ndjsonMarshalling) supportedMediaTypes(t reflect.Type) []MediaType {
+	return []MediaType{NDJSONContentType}
+}
+
+func (*ndjsonMarshalling) marshall(value interface{}, w io.Writer, mediaType MediaType) error {
+	encoder := json.NewEncoder(w) // Encode terminates each value with a newline
+	v := reflect.ValueOf(value)
+	if !v.IsValid() || !isRecordList(v.Type()) {
+		return encoder.Encode(value)
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err := encoder.Encode(v.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (*ndjsonMarshalling) canUnmarshall(t reflect.Type, mediaType MediaType) bool {
+	contentType, _, err := mime.ParseMediaType(string(mediaType))
+	if err != nil {
+		return false
+	}
+	return contentType == string(NDJSONContentType)
+}
+
+func (*ndjsonMarshalling) unmarshall(r io.Reader, t reflect.Type, mediaType MediaType) (interface{}, error) {
+	var result records
+	decoder := json.NewDecoder(r)
+	for {
+		ptrToData := reflect.New(t)
+		err := decoder.Decode(ptrToData.Interface())
+		if err == io.EOF {
+			return result, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("record #%d: %v", len(result), err)
+		}
+		result = append(result, reflect.Indirect(ptrToData).Interface())
+	}
+}
+
+// csvMarshalling supports comma separated values (RFC 4180), where each row is a record.
+// Rows map onto either a []string, or onto the fields of a struct according to a header row. Columns are matched by
+// the `csv` struct tag of fields, defaulting to their (case insensitive) name, and cells are converted according
+// to the text/plain rules. Unknown columns are ignored.
+// When marshalling, the elements of a slice are aggregated into one row each, preceded by a header row for structs,
+// and cells are formatted according to the fmt package.
+type csvMarshalling struct {
+}
+
+func (*csvMarshalling) supportedMediaTypes(t reflect.Type) []MediaType {
+	if t == nil {
+		return nil
+	}
+	if !isCSVRow(t) && isRecordList(t) {
+		t = t.Elem()
+	}
+	if isCSVRow(t) || t.Kind() == reflect.Struct {
+		return []MediaType{CSVContentType}
+	}
+	return nil
+}
+
+func (*csvMarshalling) marshall(value interface{}, w io.Writer, mediaType MediaType) error {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		return fmt.Errorf("cannot marshall nil as CSV")
+	}
+	t := v.Type()
+	rows := []reflect.Value{v}
+	if !isCSVRow(t) && isRecordList(t) {
+		t = t.Elem()
+		rows = make([]reflect.Value, v.Len())
+		for i := range rows {
+			rows[i] = v.Index(i)
+		}
+	}
+
+	writer := csv.NewWriter(w)
+	if t.Kind() == reflect.Struct {
+		var header []string
+		for i := 0; i < t.NumField(); i++ {
+			if name, ok := csvColumn(t.Field(i)); ok {
+				header = append(header, name)
+			}
+		}
+		if err := writer.Write(header); err != nil {
+			return err
+		}
+	}
+	for _, row := range rows {
+		var record []string
+		if t.Kind() == reflect.Struct {
+			for i := 0; i < t.NumField(); i++ {
+				if _, ok := csvColumn(t.Field(i)); ok {
+					record = append(record, fmt.Sprint(row.Field(i).Interface()))
+				}
+			}
+		} else {
+			record = row.Convert(reflect.TypeOf(record)).Interface().([]string)
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func (*csvMarshalling) canUnmarshall(t reflect.Type, mediaType MediaType) bool {
+	contentType, _, err := mime.ParseMediaType(string(mediaType))
+	if err != nil {
+		return false
+	}
+	return contentType == string(CSVContentType) && (isCSVRow(t) || t.Kind() == reflect.Struct)
+}
+
+func (*csvMarshalling) unmarshall(r io.Reader, t reflect.Type, mediaType MediaType) (interface{}, error) {
+	reader := csv.NewReader(r)
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var result records
+	if isCSVRow(t) {
+		for _, row := range rows {
+			result = append(result, reflect.ValueOf(row).Convert(t).Interface())
+		}
+		return result, nil
+	}
+	if len(rows) == 0 {
+		return result, nil
+	}
+
+	header := rows[0]
+	fields := make([]int, len(header)) // index of the struct field for each column, or -1
+	for c, name := range header {
+		fields[c] = -1
+		for i := 0; i < t.NumField(); i++ {
+			if column, ok := csvColumn(t.Field(i)); ok && strings.EqualFold(column, strings.TrimSpace(name)) {
+				fields[c] = i
+				break
+			}
+		}
+	}
+	text := &textMarshalling{}
+	for n, row := range rows[1:] {
+		record := reflect.New(t).Elem()
+		for c, cell := range row {
+			if fields[c] < 0 {
+				continue
+			}
+			field := t.Field(fields[c])
+			if !text.canUnmarshall(field.Type, AssumedContentType) {
+				return nil, fmt.Errorf("unsupported type %v for csv column %v", field.Type, header[c])
+			}
+			converted, err := text.unmarshall(strings.NewReader(cell), field.Type, AssumedContentType)
+			if err != nil {
+				return nil, fmt.Errorf("record #%d, column %v: %v", n, header[c], err)
+			}
+			record.Field(fields[c]).Set(reflect.ValueOf(converted).Convert(field.Type))
+		}
+		result = append(result, record.Interface())
+	}
+	return result, nil
+}
+
+// isRecordList returns true if t is a slice or array whose elements should be marshalled as individual records
+func isRecordList(t reflect.Type) bool {
+	return (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && t.Elem().Kind() != reflect.Uint8
+}
+
+// isCSVRow returns true if t is a slice of strings, that is a raw CSV row
+func isCSVRow(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem() == reflect.TypeOf("")
+}
+
+// csvColumn returns the name of the CSV column the given field maps onto, if any
+func csvColumn(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get(csvTag)
+	if field.PkgPath != "" || tag == "-" {
+		return "", false
+	}
+	if tag == "" {
+		return field.Name, true
+	}
+	return tag, true
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"math/rand"
+	"reflect"
+	"time"
+)
+
+const (
+	DefaultRetryBackoff    = 100 * time.Millisecond
+	DefaultRetryMaxBackoff = 10 * time.Second
+)
+
+// RetryableError may be implemented by errors returned by functions, to tell whether invoking the function again could
+// succeed. Errors that don't implement it are considered retryable. Note that a function plugin need not import this
+// package: having a Retryable() bool method is enough.
+type RetryableError interface {
+	error
+	Retryable() bool
+}
+
+// retryPolicy governs how many times, and how often, a 'direct' function returning an error is invoked again.
+// The zero value makes no retries.
+type retryPolicy struct {
+	maxAttempts    int // including the first one
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// WithRetries makes 'direct' functions that return an error be invoked again, up to maxAttempts times in total.
+// Attempts are separated by an exponential backoff, starting at initialBackoff and capped at maxBackoff,
+// with jitter. See RetryableError.
+func WithRetries(maxAttempts int, initialBackoff time.Duration, maxBackoff time.Duration) InvokerOption {
+	return func(invoker *pluginInvoker) {
+		if maxAttempts < 1 {
+			maxAttempts = 1
+		}
+		invoker.retry = retryPolicy{maxAttempts: maxAttempts, initialBackoff: initialBackoff, maxBackoff: maxBackoff}
+	}
+}
+
+// shouldRetry returns true if the given error, returned by the given attempt (starting at 1), warrants another one
+func (rp retryPolicy) shouldRetry(err error, attempt int) bool {
+	if attempt >= rp.maxAttempts {
+		if rp.maxAttempts > 1 {
+			metrics.Add(retriesExhaustedMetric, 1)
+		}
+		return false
+	}
+	if r, ok := err.(RetryableError); ok && !r.Retryable() {
+		metrics.Add(permanentErrorsMetric, 1)
+		return false
+	}
+	return true
+}
+
+// backoff returns how long to wait after the given (failed) attempt, starting at 1. The exponential backoff is
+// randomized by up to half of its value, so that failing invocations don't retry in lockstep.
+func (rp retryPolicy) backoff(attempt int) time.Duration {
+	backoff := rp.initialBackoff
+	for i := 1; i < attempt && backoff < rp.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > rp.maxBackoff {
+		backoff = rp.maxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// callWithRetries invokes fn with the given arguments, again as long as it returns an error that the retry policy
+// deems worth retrying, and done is not closed. It returns the results of the last attempt, and the number of attempts
+// made.
+func (rp retryPolicy) callWithRetries(fn reflect.Value, args []reflect.Value, done <-chan struct{}) ([]reflect.Value, int) {
+	for attempt := 1; ; attempt++ {
+		fnResult := fn.Call(args)
+		if !isErroring(fn) || fnResult[len(fnResult)-1].IsNil() {
+			return fnResult, attempt
+		}
+		err := fnResult[len(fnResult)-1].Interface().(error)
+		if !rp.shouldRetry(err, attempt) {
+			return fnResult, attempt
+		}
+		metrics.Add(retriesMetric, 1)
+		backoff := rp.backoff(attempt)
+		Trace.Printf("[-Function Wrapper->] Attempt #%d failed with %v, retrying in %v\n", attempt, err, backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			Trace.Printf("[-Function Wrapper->] Giving up retrying, as the stream is over\n")
+			return fnResult, attempt
+		}
+	}
+}
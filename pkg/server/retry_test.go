@@ -0,0 +1,82 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type permanentError struct{}
+
+func (permanentError) Error() string {
+	return "permanent"
+}
+
+func (permanentError) Retryable() bool {
+	return false
+}
+
+var _ = Describe("Retry policy", func() {
+	policy := retryPolicy{maxAttempts: 5, initialBackoff: 100 * time.Millisecond, maxBackoff: time.Second}
+
+	It("should back off exponentially, with jitter", func() {
+		for attempt, expected := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond,
+			4: 800 * time.Millisecond, 5: time.Second, 10: time.Second} {
+			backoff := policy.backoff(attempt)
+			Expect(backoff).To(BeNumerically(">=", expected/2))
+			Expect(backoff).To(BeNumerically("<=", expected))
+		}
+	})
+
+	It("should retry up to the maximum number of attempts", func() {
+		Expect(policy.shouldRetry(errors.New("transient"), 4)).To(BeTrue())
+		Expect(policy.shouldRetry(errors.New("transient"), 5)).To(BeFalse())
+	})
+
+	It("should not retry permanent errors", func() {
+		Expect(policy.shouldRetry(permanentError{}, 1)).To(BeFalse())
+	})
+
+	It("should stop backing off once done is closed", func() {
+		calls := 0
+		fn := reflect.ValueOf(func() error {
+			calls++
+			return errors.New("transient")
+		})
+		done := make(chan struct{})
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			close(done)
+		}()
+		start := time.Now()
+		result, attempts := retryPolicy{maxAttempts: 5, initialBackoff: time.Minute, maxBackoff: time.Minute}.
+			callWithRetries(fn, nil, done)
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(attempts).To(Equal(1))
+		Expect(calls).To(Equal(1))
+		Expect(result[0].Interface()).To(MatchError("transient"))
+	})
+
+	It("should not retry by default", func() {
+		Expect(retryPolicy{}.shouldRetry(errors.New("transient"), 1)).To(BeFalse())
+	})
+})
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2018-Present the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/projectriff/go-function-invoker/pkg/function"
+	"github.com/projectriff/go-function-invoker/pkg/rpc"
+)
+
+const (
+	// Protocols spoken with the sidecar / streaming processor
+
+	MessageFunctionProtocol = "grpc"     // the original function.MessageFunction protocol
+	RiffRpcProtocol         = "riff-rpc" // the rpc.Riff streaming protocol
+)
+
+// riffStream adapts the rpc.Riff streaming protocol, whose start frame has already been consumed, to the
+// function.Message model. Stream indexes of frames are translated to and from the Input header and output index.
+type riffStream struct {
+	rpc.Riff_InvokeServer
+}
+
+func (rs riffStream) Recv() (*function.Message, error) {
+	signal, err := rs.Riff_InvokeServer.Recv()
+	if err != nil {
+		return nil, err
+	}
+	frame := signal.GetData()
+	if frame == nil {
+		return nil, invokerError{code: ProtocolError, message: fmt.Sprintf("Unexpected signal after start frame: %v", signal)}
+	}
+
+	headers := make(map[string]*function.Message_HeaderValue, len(frame.Headers)+2)
+	for k, v := range frame.Headers {
+		headers[k] = &function.Message_HeaderValue{Values: []string{v}}
+	}
+	if frame.ContentType != "" {
+		headers[ContentType] = &function.Message_HeaderValue{Values: []string{frame.ContentType}}
+	}
+	headers[Input] = &function.Message_HeaderValue{Values: []string{strconv.Itoa(int(frame.ArgIndex))}}
+	return &function.Message{Payload: frame.Payload, Headers: headers}, nil
+}
+
+func (rs riffStream) Send(message *function.Message, output int) error {
+	frame := &rpc.OutputFrame{
+		Payload:     message.Payload,
+		Headers:     make(map[string]string, len(message.Headers)),
+		ResultIndex: int32(output),
+	}
+	for k, v := range message.Headers {
+		if k == ContentType {
+			frame.ContentType = v.Values[0]
+		} else {
+			frame.Headers[k] = strings.Join(v.Values, ", ")
+		}
+	}
+	return rs.Riff_InvokeServer.Send(&rpc.OutputSignal{Frame: &rpc.OutputSignal_Data{Data: frame}})
+}
+
+// Invoke implements the rpc.Riff streaming protocol. The first signal is expected to be a start frame,
+// which conveys the content types expected for each output of the function.
+func (pi *pluginInvoker) Invoke(stream rpc.Riff_InvokeServer) error {
+	signal, err := stream.Recv()
+	if err != nil {
+		return statusError(err)
+	}
+	start := signal.GetStart()
+	if start == nil {
+		return statusError(invokerError{code: ProtocolError, message: fmt.Sprintf("Expected a start frame, got %v", signal)})
+	}
+	if len(start.InputNames) > len(pi.inTypes) {
+		return statusError(invokerError{code: ProtocolError, message: fmt.Sprintf("Function has %d input(s), %d were requested", len(pi.inTypes), len(start.InputNames))})
+	}
+	if len(start.ExpectedContentTypes) > pi.outCount {
+		return statusError(invokerError{code: ProtocolError, message: fmt.Sprintf("Function has %d output(s), %d were requested", pi.outCount, len(start.ExpectedContentTypes))})
+	}
+	Trace.Printf("[Sidecar -> Function] Received start frame %v\n", start)
+
+	return statusError(pi.invoke(riffStream{stream}, start.ExpectedContentTypes))
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectriff/go-function-invoker/pkg/rpc"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+var _ = Describe("Riff RPC protocol", func() {
+
+	var (
+		handler    string
+		gRpcServer *grpc.Server
+		processor  rpc.Riff_InvokeClient // acts as a fake streaming processor
+		cancel     context.CancelFunc
+	)
+
+	JustBeforeEach(func() {
+		invoker, err := NewInvoker(fmt.Sprintf("%s?%s=%s", builtPlugin, Handler, handler))
+		Expect(err).NotTo(HaveOccurred())
+
+		port := 1024 + rand.Intn(65536-1024)
+
+		gRpcServer = grpc.NewServer()
+		listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+		Expect(err).NotTo(HaveOccurred())
+		rpc.RegisterRiffServer(gRpcServer, invoker)
+		go func() {
+			gRpcServer.Serve(listener)
+		}()
+
+		ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
+		conn, err := grpc.DialContext(ctx, fmt.Sprintf("localhost:%v", port), grpc.WithInsecure(), grpc.WithBlock())
+		Expect(err).NotTo(HaveOccurred())
+
+		ctx, cancel = context.WithCancel(context.Background())
+		processor, err = rpc.NewRiffClient(conn).Invoke(ctx)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		cancel()
+		gRpcServer.Stop()
+	})
+
+	Context("with a streaming function", func() {
+		BeforeEach(func() {
+			handler = "RunLengthEncode"
+		})
+
+		It("should honor the content types of the start frame", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := processor.Send(start("application/json"))
+				Expect(err).NotTo(HaveOccurred())
+				for _, w := range []string{"world", "world", "hello"} {
+					err = processor.Send(data(w, "text/plain", 0))
+					Expect(err).NotTo(HaveOccurred())
+				}
+				err = processor.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			result, err := processor.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.GetData().ContentType).To(Equal("application/json"))
+			Expect(result.GetData().Payload).To(Equal([]byte(`{"Word":"world","Count":2}` + "\n")))
+
+			result, err = processor.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.GetData().Payload).To(Equal([]byte(`{"Word":"hello","Count":1}` + "\n")))
+
+			_, err = processor.Recv()
+			Expect(err).To(MatchError(io.EOF))
+		})
+
+		It("should require a start frame", func() {
+			err := processor.Send(data("world", "text/plain", 0))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = processor.Recv()
+			Expect(err).To(MatchError(ContainSubstring("Expected a start frame")))
+		})
+	})
+
+	Context("with a function that has several inputs and outputs", func() {
+		BeforeEach(func() {
+			handler = "Join"
+		})
+
+		It("should route frames according to their indexes", func() {
+			go func() {
+				defer GinkgoRecover()
+				err := processor.Send(start("text/plain", "application/json"))
+				Expect(err).NotTo(HaveOccurred())
+				err = processor.Send(data("ab", "text/plain", 0))
+				Expect(err).NotTo(HaveOccurred())
+				err = processor.Send(data("3", "text/plain", 1))
+				Expect(err).NotTo(HaveOccurred())
+				err = processor.CloseSend()
+				Expect(err).NotTo(HaveOccurred())
+			}()
+
+			result, err := processor.Recv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.GetData().ResultIndex).To(Equal(int32(1)))
+			Expect(result.GetData().ContentType).To(Equal("application/json"))
+			Expect(result.GetData().Payload).To(Equal([]byte(`"ababab"` + "\n")))
+
+			_, err = processor.Recv()
+			Expect(err).To(MatchError(io.EOF))
+		})
+
+		It("should reject start frames asking for too many outputs", func() {
+			err := processor.Send(start("text/plain", "text/plain", "text/plain"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = processor.Recv()
+			Expect(err).To(MatchError(ContainSubstring("Function has 2 output(s), 3 were requested")))
+		})
+	})
+})
+
+func start(expectedContentTypes ...string) *rpc.InputSignal {
+	return &rpc.InputSignal{Frame: &rpc.InputSignal_Start{Start: &rpc.StartFrame{ExpectedContentTypes: expectedContentTypes}}}
+}
+
+func data(payload string, contentType string, index int32) *rpc.InputSignal {
+	return &rpc.InputSignal{Frame: &rpc.InputSignal_Data{Data: &rpc.InputFrame{Payload: []byte(payload), ContentType: contentType, ArgIndex: index}}}
+}
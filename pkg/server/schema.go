@@ -0,0 +1,618 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"plugin"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Url query parameters holding the path to a JSON Schema for inputs (resp. outputs) of the function
+	InputSchemaParam  = "inputSchema"
+	OutputSchemaParam = "outputSchema"
+
+	// Optional string (or []byte) variables exported by the plugin, holding a JSON Schema for inputs (resp. outputs)
+	InputSchemaSymbol  = "InputSchema"
+	OutputSchemaSymbol = "OutputSchema"
+)
+
+// jsonSchema validates generic json values (as decoded with json.Decoder.UseNumber) against a JSON Schema document.
+// The following keywords are supported, others being ignored: type, enum, const, properties, required,
+// additionalProperties, minProperties, maxProperties, items, minItems, maxItems, uniqueItems, minLength, maxLength,
+// pattern, minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf, allOf, anyOf, oneOf, not and local $ref
+// (such as "#/definitions/foo"). References that loop back without descending into the value are rejected.
+type jsonSchema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+	acyclic  map[uintptr]bool // the (object) subschemas known not to start a $ref cycle, see checkCycles
+	compiled map[uintptr]bool // the (object) subschemas compiled already, as $ref may lead to them several times
+}
+
+// newJSONSchema parses the given JSON Schema document, which must be an object or a boolean.
+func newJSONSchema(b []byte) (*jsonSchema, error) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var root interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return nil, fmt.Errorf("invalid JSON Schema: %v", err)
+	}
+	schema := &jsonSchema{root: root, patterns: make(map[string]*regexp.Regexp), acyclic: make(map[uintptr]bool),
+		compiled: make(map[uintptr]bool)}
+	if err := schema.compile(root); err != nil {
+		return nil, fmt.Errorf("invalid JSON Schema: %v", err)
+	}
+	return schema, nil
+}
+
+// compile checks the structure of the given (sub)schema, and compiles the regular expressions it holds. Subschemas
+// referred to with $ref are compiled too, wherever they are in the document.
+func (s *jsonSchema) compile(schema interface{}) error {
+	switch v := schema.(type) {
+	case bool:
+		return nil
+	case map[string]interface{}:
+		id := reflect.ValueOf(v).Pointer()
+		if s.compiled[id] {
+			return nil
+		}
+		s.compiled[id] = true
+		if p, ok := v["pattern"].(string); ok {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return err
+			}
+			s.patterns[p] = re
+		}
+		if err := s.checkCycles(v, make(map[uintptr]bool)); err != nil {
+			return err
+		}
+		if ref, ok := v["$ref"].(string); ok {
+			if target, err := s.resolve(ref); err == nil { // unresolvable references are reported when validating
+				if err := s.compile(target); err != nil {
+					return err
+				}
+			}
+		}
+		for _, k := range []string{"items", "additionalProperties", "not"} {
+			if sub, ok := v[k]; ok {
+				if err := s.compileSubschemas(k, sub); err != nil {
+					return err
+				}
+			}
+		}
+		for _, k := range []string{"properties", "definitions", "$defs"} {
+			if subs, ok := v[k].(map[string]interface{}); ok {
+				for _, sub := range subs {
+					if err := s.compile(sub); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		for _, k := range []string{"allOf", "anyOf", "oneOf"} {
+			if subs, ok := v[k].([]interface{}); ok {
+				for _, sub := range subs {
+					if err := s.compile(sub); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("a schema should be an object or a boolean, not %v", schema)
+	}
+}
+
+func (s *jsonSchema) compileSubschemas(keyword string, sub interface{}) error {
+	if keyword == "items" {
+		if list, ok := sub.([]interface{}); ok { // tuple validation
+			for _, item := range list {
+				if err := s.compile(item); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return s.compile(sub)
+}
+
+// checkCycles returns an error if following the $ref, allOf, anyOf, oneOf and not keywords from the given subschema
+// leads back (necessarily through a $ref) to a subschema being visited, as in {"$ref": "#"} or definitions referring to one another. Those apply to
+// the same value as the subschema holding them, so that checking it would recurse forever. Recursion through other
+// keywords (such as properties or items) is fine, as it descends into the value.
+func (s *jsonSchema) checkCycles(schema map[string]interface{}, visiting map[uintptr]bool) error {
+	id := reflect.ValueOf(schema).Pointer()
+	if s.acyclic[id] {
+		return nil
+	}
+	visiting[id] = true
+	var next []interface{}
+	if ref, ok := schema["$ref"].(string); ok {
+		target, err := s.resolve(ref)
+		if err != nil {
+			return nil // reported when validating
+		}
+		if t, ok := target.(map[string]interface{}); ok && visiting[reflect.ValueOf(t).Pointer()] {
+			return fmt.Errorf("circular $ref %v", ref)
+		}
+		next = []interface{}{target}
+	} else {
+		for _, k := range []string{"allOf", "anyOf", "oneOf"} {
+			if subs, ok := schema[k].([]interface{}); ok {
+				next = append(next, subs...)
+			}
+		}
+		if sub, ok := schema["not"]; ok {
+			next = append(next, sub)
+		}
+	}
+	for _, sub := range next {
+		if sub, ok := sub.(map[string]interface{}); ok {
+			if err := s.checkCycles(sub, visiting); err != nil {
+				return err
+			}
+		}
+	}
+	delete(visiting, id)
+	s.acyclic[id] = true
+	return nil
+}
+
+// validate returns the list of violations of the schema by the given generic value, each prefixed by the
+// JSON pointer to the offending part of the value.
+func (s *jsonSchema) validate(value interface{}) []string {
+	var violations []string
+	s.check(s.root, value, "", &violations)
+	return violations
+}
+
+// validateJSON validates the json values read from r (there may be several of them, as in newline delimited json)
+func (s *jsonSchema) validateJSON(r io.Reader) ([]string, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var violations []string
+	for i := 0; ; i++ {
+		var value interface{}
+		err := decoder.Decode(&value)
+		if err == io.EOF {
+			return violations, nil
+		} else if err != nil {
+			return nil, err
+		}
+		for _, v := range s.validate(value) {
+			if i > 0 {
+				v = fmt.Sprintf("record #%d: %v", i, v)
+			}
+			violations = append(violations, v)
+		}
+	}
+}
+
+func (s *jsonSchema) check(schema interface{}, value interface{}, path string, violations *[]string) {
+	fail := func(format string, args ...interface{}) {
+		location := path
+		if location == "" {
+			location = "/"
+		}
+		*violations = append(*violations, location+": "+fmt.Sprintf(format, args...))
+	}
+
+	switch v := schema.(type) {
+	case bool:
+		if !v {
+			fail("no value is allowed")
+		}
+		return
+	case map[string]interface{}:
+		schema := v
+		if ref, ok := schema["$ref"].(string); ok {
+			target, err := s.resolve(ref)
+			if err != nil {
+				fail("%v", err)
+			} else {
+				s.check(target, value, path, violations)
+			}
+			return
+		}
+
+		if t, ok := schema["type"]; ok && !matchesType(t, value) {
+			fail("should be of type %v, was %v", typeNames(t), jsonTypeOf(value))
+			return
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			found := false
+			for _, e := range enum {
+				found = found || jsonEqual(e, value)
+			}
+			if !found {
+				fail("should be one of %v", jsonString(enum))
+			}
+		}
+		if c, ok := schema["const"]; ok && !jsonEqual(c, value) {
+			fail("should be %v", jsonString(c))
+		}
+
+		switch value := value.(type) {
+		case map[string]interface{}:
+			s.checkObject(schema, value, path, violations, fail)
+		case []interface{}:
+			s.checkArray(schema, value, path, violations, fail)
+		case string:
+			length := float64(utf8.RuneCountInString(value))
+			if n, ok := schemaNumber(schema, "minLength"); ok && length < n {
+				fail("should be at least %v characters long", n)
+			}
+			if n, ok := schemaNumber(schema, "maxLength"); ok && length > n {
+				fail("should be at most %v characters long", n)
+			}
+			if p, ok := schema["pattern"].(string); ok && !s.patterns[p].MatchString(value) {
+				fail("should match pattern %v", p)
+			}
+		case json.Number:
+			f, _ := value.Float64()
+			if n, ok := schemaNumber(schema, "minimum"); ok && f < n {
+				fail("should be >= %v", n)
+			}
+			if n, ok := schemaNumber(schema, "maximum"); ok && f > n {
+				fail("should be <= %v", n)
+			}
+			if n, ok := schemaNumber(schema, "exclusiveMinimum"); ok && f <= n {
+				fail("should be > %v", n)
+			}
+			if n, ok := schemaNumber(schema, "exclusiveMaximum"); ok && f >= n {
+				fail("should be < %v", n)
+			}
+			if n, ok := schemaNumber(schema, "multipleOf"); ok && n > 0 {
+				if q := f / n; math.Abs(q-math.Round(q)) > 1e-9 {
+					fail("should be a multiple of %v", n)
+				}
+			}
+		}
+
+		if subs, ok := schema["allOf"].([]interface{}); ok {
+			for _, sub := range subs {
+				s.check(sub, value, path, violations)
+			}
+		}
+		if subs, ok := schema["anyOf"].([]interface{}); ok {
+			if s.countMatching(subs, value, path) == 0 {
+				fail("should match at least one schema of anyOf")
+			}
+		}
+		if subs, ok := schema["oneOf"].([]interface{}); ok {
+			if n := s.countMatching(subs, value, path); n != 1 {
+				fail("should match exactly one schema of oneOf, matched %d", n)
+			}
+		}
+		if sub, ok := schema["not"]; ok {
+			if s.countMatching([]interface{}{sub}, value, path) == 1 {
+				fail("should not match schema %v", jsonString(sub))
+			}
+		}
+	}
+}
+
+func (s *jsonSchema) checkObject(schema map[string]interface{}, value map[string]interface{}, path string, violations *[]string, fail func(string, ...interface{})) {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				if _, present := value[name]; !present {
+					fail("missing required property %v", name)
+				}
+			}
+		}
+	}
+	if n, ok := schemaNumber(schema, "minProperties"); ok && float64(len(value)) < n {
+		fail("should have at least %v properties", n)
+	}
+	if n, ok := schemaNumber(schema, "maxProperties"); ok && float64(len(value)) > n {
+		fail("should have at most %v properties", n)
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	additional, hasAdditional := schema["additionalProperties"]
+	for _, name := range sortedNames(value) {
+		if sub, ok := properties[name]; ok {
+			s.check(sub, value[name], path+"/"+escapePointer(name), violations)
+		} else if hasAdditional {
+			if allowed, ok := additional.(bool); ok && !allowed {
+				fail("unexpected property %v", name)
+			} else {
+				s.check(additional, value[name], path+"/"+escapePointer(name), violations)
+			}
+		}
+	}
+}
+
+func (s *jsonSchema) checkArray(schema map[string]interface{}, value []interface{}, path string, violations *[]string, fail func(string, ...interface{})) {
+	if n, ok := schemaNumber(schema, "minItems"); ok && float64(len(value)) < n {
+		fail("should have at least %v items", n)
+	}
+	if n, ok := schemaNumber(schema, "maxItems"); ok && float64(len(value)) > n {
+		fail("should have at most %v items", n)
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := range value {
+			for j := 0; j < i; j++ {
+				if jsonEqual(value[i], value[j]) {
+					fail("items #%d and #%d should be unique", j, i)
+				}
+			}
+		}
+	}
+	switch items := schema["items"].(type) {
+	case []interface{}:
+		for i := 0; i < len(items) && i < len(value); i++ {
+			s.check(items[i], value[i], path+"/"+strconv.Itoa(i), violations)
+		}
+	case nil:
+	default:
+		for i := range value {
+			s.check(items, value[i], path+"/"+strconv.Itoa(i), violations)
+		}
+	}
+}
+
+// countMatching returns how many of the given schemas the value conforms to
+func (s *jsonSchema) countMatching(schemas []interface{}, value interface{}, path string) int {
+	n := 0
+	for _, sub := range schemas {
+		var ignored []string
+		s.check(sub, value, path, &ignored)
+		if len(ignored) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// resolve returns the subschema designated by a local reference, which is a JSON pointer in the document fragment
+func (s *jsonSchema) resolve(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported non local $ref %v", ref)
+	}
+	current := s.root
+	for _, token := range strings.Split(strings.TrimPrefix(ref, "#"), "/")[1:] {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		switch c := current.(type) {
+		case map[string]interface{}:
+			current = c[token]
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, fmt.Errorf("unresolvable $ref %v", ref)
+			}
+			current = c[i]
+		default:
+			current = nil
+		}
+		if current == nil {
+			return nil, fmt.Errorf("unresolvable $ref %v", ref)
+		}
+	}
+	return current, nil
+}
+
+// matchesType returns true if value is of the given schema type, or of one of the given list of types
+func matchesType(t interface{}, value interface{}) bool {
+	if list, ok := t.([]interface{}); ok {
+		for _, e := range list {
+			if matchesType(e, value) {
+				return true
+			}
+		}
+		return false
+	}
+	actual := jsonTypeOf(value)
+	return t == actual || t == "number" && actual == "integer"
+}
+
+func typeNames(t interface{}) string {
+	if list, ok := t.([]interface{}); ok {
+		names := make([]string, len(list))
+		for i, e := range list {
+			names[i] = fmt.Sprint(e)
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+// jsonTypeOf returns the JSON Schema type name of a generic value
+func jsonTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	default:
+		return reflect.TypeOf(value).String()
+	}
+}
+
+// jsonEqual compares generic values, numbers being compared by value
+func jsonEqual(a, b interface{}) bool {
+	na, aNumber := a.(json.Number)
+	nb, bNumber := b.(json.Number)
+	if aNumber && bNumber {
+		fa, _ := na.Float64()
+		fb, _ := nb.Float64()
+		return fa == fb
+	}
+	switch va := a.(type) {
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok || len(va) != len(vb) {
+			return false
+		}
+		for i := range va {
+			if !jsonEqual(va[i], vb[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok || len(va) != len(vb) {
+			return false
+		}
+		for k := range va {
+			if !jsonEqual(va[k], vb[k]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+func schemaNumber(schema map[string]interface{}, keyword string) (float64, bool) {
+	n, ok := schema[keyword].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+func jsonString(value interface{}) string {
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+func sortedNames(m map[string]interface{}) []string {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func escapePointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
+// lookupSchemas loads the optional input and output schemas, from the paths given as url query parameters or else
+// from the variables exported by the plugin.
+func (invoker *pluginInvoker) lookupSchemas(lib *plugin.Plugin, query map[string][]string) error {
+	var err error
+	if invoker.inputSchema, err = loadSchema(lib, query, InputSchemaParam, InputSchemaSymbol); err != nil {
+		return err
+	}
+	invoker.outputSchema, err = loadSchema(lib, query, OutputSchemaParam, OutputSchemaSymbol)
+	return err
+}
+
+func loadSchema(lib *plugin.Plugin, query map[string][]string, param string, symbol string) (*jsonSchema, error) {
+	var b []byte
+	source := symbol
+	if paths := query[param]; len(paths) > 0 {
+		content, err := ioutil.ReadFile(paths[0])
+		if err != nil {
+			return nil, err
+		}
+		b, source = content, paths[0]
+	} else if sym, err := lib.Lookup(symbol); err == nil {
+		switch v := sym.(type) {
+		case *string:
+			b = []byte(*v)
+		case *[]byte:
+			b = *v
+		default:
+			return nil, fmt.Errorf("exported symbol %v should be a string or []byte variable, was %T", symbol, sym)
+		}
+	} else {
+		return nil, nil
+	}
+	schema, err := newJSONSchema(b)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", source, err)
+	}
+	return schema, nil
+}
+
+// validateInput checks the given json (or newline delimited json) payload against the input schema, if any
+func (pi *pluginInvoker) validateInput(payload []byte, contentType MediaType) error {
+	if pi.inputSchema == nil || !isJSONMediaType(contentType) && !hasMediaType(contentType, NDJSONContentType) {
+		return nil
+	}
+	r, err := decodingReader(bytes.NewReader(payload), contentType)
+	if err != nil {
+		return invokerError{code: ErrorWhileUnmarshalling, cause: err, contentType: contentType}
+	}
+	violations, err := pi.inputSchema.validateJSON(r)
+	if err != nil {
+		return invokerError{code: ErrorWhileUnmarshalling, cause: err, contentType: contentType}
+	}
+	if len(violations) > 0 {
+		return invokerError{code: InputSchemaViolation, message: "Input does not conform to schema: " + strings.Join(violations, "; "),
+			contentType: contentType}
+	}
+	return nil
+}
+
+// validateOutput checks the json representation of the given function result (or of its data, for a CloudEvents
+// envelope) against the output schema, if any
+func (pi *pluginInvoker) validateOutput(value interface{}) error {
+	if pi.outputSchema == nil {
+		return nil
+	}
+	if field, ok := cloudEventDataField(reflect.TypeOf(value)); ok {
+		value = reflect.ValueOf(value).FieldByIndex(field.Index).Interface()
+	}
+	generic, err := toGeneric(value)
+	if err != nil {
+		return invokerError{code: ErrorWhileMarshalling, cause: err}
+	}
+	if violations := pi.outputSchema.validate(generic); len(violations) > 0 {
+		return invokerError{code: OutputSchemaViolation, message: "Output does not conform to schema: " + strings.Join(violations, "; ")}
+	}
+	return nil
+}
+
+// hasMediaType returns true if mediaType, disregarding parameters, is the given one
+func hasMediaType(mediaType MediaType, expected MediaType) bool {
+	mt, _, err := mime.ParseMediaType(string(mediaType))
+	return err == nil && MediaType(mt) == expected
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JSON Schema", func() {
+
+	validate := func(schema string, value string) []string {
+		s, err := newJSONSchema([]byte(schema))
+		Expect(err).NotTo(HaveOccurred())
+		violations, err := s.validateJSON(bytes.NewBufferString(value))
+		Expect(err).NotTo(HaveOccurred())
+		return violations
+	}
+
+	It("should check types", func() {
+		Expect(validate(`{"type": "integer"}`, `3`)).To(BeEmpty())
+		Expect(validate(`{"type": "number"}`, `3`)).To(BeEmpty())
+		Expect(validate(`{"type": ["string", "null"]}`, `null`)).To(BeEmpty())
+		Expect(validate(`{"type": "integer"}`, `3.5`)).To(Equal([]string{"/: should be of type integer, was number"}))
+		Expect(validate(`{"type": ["string", "null"]}`, `{}`)).To(Equal([]string{"/: should be of type string or null, was object"}))
+	})
+
+	It("should check objects", func() {
+		schema := `{
+			"type": "object",
+			"required": ["word", "count"],
+			"properties": {
+				"word": {"type": "string", "minLength": 2, "pattern": "^[a-z]+$"},
+				"count": {"type": "integer", "minimum": 0},
+				"kind": {"enum": ["noun", "verb"]}
+			},
+			"additionalProperties": false
+		}`
+		Expect(validate(schema, `{"word": "riff", "count": 1, "kind": "noun"}`)).To(BeEmpty())
+		Expect(validate(schema, `{"word": "R", "kind": "adverb", "extra": true}`)).To(Equal([]string{
+			"/: missing required property count",
+			"/: unexpected property extra",
+			`/kind: should be one of ["noun","verb"]`,
+			"/word: should be at least 2 characters long",
+			"/word: should match pattern ^[a-z]+$",
+		}))
+	})
+
+	It("should check arrays", func() {
+		schema := `{"type": "array", "items": {"type": "number", "exclusiveMaximum": 10}, "maxItems": 3, "uniqueItems": true}`
+		Expect(validate(schema, `[1, 2.5]`)).To(BeEmpty())
+		Expect(validate(schema, `[1, 1.0, 10, 4]`)).To(Equal([]string{
+			"/: should have at most 3 items",
+			"/: items #0 and #1 should be unique",
+			"/2: should be < 10",
+		}))
+	})
+
+	It("should combine schemas", func() {
+		schema := `{
+			"definitions": {"positive": {"type": "number", "exclusiveMinimum": 0}},
+			"oneOf": [{"$ref": "#/definitions/positive"}, {"type": "string", "not": {"const": "zero"}}]
+		}`
+		Expect(validate(schema, `1`)).To(BeEmpty())
+		Expect(validate(schema, `"one"`)).To(BeEmpty())
+		Expect(validate(schema, `"zero"`)).To(Equal([]string{"/: should match exactly one schema of oneOf, matched 0"}))
+		Expect(validate(`{"anyOf": [{"multipleOf": 3}, {"multipleOf": 5}]}`, `7`)).To(Equal([]string{"/: should match at least one schema of anyOf"}))
+	})
+
+	It("should validate each record of newline delimited json", func() {
+		Expect(validate(`{"type": "string"}`, "\"a\"\n1\n")).To(Equal([]string{"record #1: /: should be of type string, was integer"}))
+	})
+
+	It("should reject invalid schemas", func() {
+		_, err := newJSONSchema([]byte(`{"properties": {"a": 3}}`))
+		Expect(err).To(MatchError(ContainSubstring("a schema should be an object or a boolean")))
+		_, err = newJSONSchema([]byte(`{"pattern": "("}`))
+		Expect(err).To(MatchError(ContainSubstring("invalid JSON Schema")))
+	})
+
+	It("should reject circular references", func() {
+		for _, schema := range []string{
+			`{"$ref": "#"}`,
+			`{"properties": {"a": {"$ref": "#/properties/a"}}}`,
+			`{"definitions": {"a": {"$ref": "#/definitions/b"}, "b": {"$ref": "#/definitions/a"}}}`,
+			`{"definitions": {"a": {"anyOf": [{"type": "string"}, {"$ref": "#"}]}}, "allOf": [{"$ref": "#/definitions/a"}]}`,
+			`{"items": {"not": {"$ref": "#/items"}}}`,
+		} {
+			_, err := newJSONSchema([]byte(schema))
+			Expect(err).To(MatchError(ContainSubstring("circular $ref")), schema)
+		}
+	})
+
+	It("should support references to any part of the document", func() {
+		schema := `{"components": {"name": {"type": "string", "pattern": "^a"}}, "$ref": "#/components/name"}`
+		Expect(validate(schema, `"abc"`)).To(BeEmpty())
+		Expect(validate(schema, `"bcd"`)).To(Equal([]string{"/: should match pattern ^a"}))
+
+		_, err := newJSONSchema([]byte(`{"components": {"name": {"pattern": "("}}, "$ref": "#/components/name"}`))
+		Expect(err).To(MatchError(ContainSubstring("invalid JSON Schema")))
+	})
+
+	It("should support recursive schemas", func() {
+		schema := `{
+			"type": "object",
+			"properties": {"name": {"type": "string"}, "children": {"type": "array", "items": {"$ref": "#"}}}
+		}`
+		Expect(validate(schema, `{"name": "a", "children": [{"name": "b", "children": [{"name": "c"}]}]}`)).To(BeEmpty())
+		Expect(validate(schema, `{"name": "a", "children": [{"name": "b", "children": [{"name": 3}]}]}`)).
+			To(Equal([]string{"/children/0/children/0/name: should be of type string, was integer"}))
+		Expect(validate(`{"properties": {"a": {"$ref": "#"}}}`, `{"a": {"a": {"a": 1}}}`)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2018 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// statusCodes maps invoker error codes onto gRPC status codes. Client errors are reported as InvalidArgument when the
+// incoming message itself is at fault, and as FailedPrecondition when the exchange can't proceed as asked for. Results
+// that can't be marshalled are a fault of the function, hence reported as Internal.
+var statusCodes = map[errorCode]codes.Code{
+	ContentTypeNotSupported:     codes.InvalidArgument,
+	InputNotSupported:           codes.InvalidArgument,
+	ContentEncodingNotSupported: codes.InvalidArgument,
+	ErrorWhileUnmarshalling:     codes.InvalidArgument,
+	InputSchemaViolation:        codes.InvalidArgument,
+	ProtocolError:               codes.FailedPrecondition,
+	AcceptNotSupported:          codes.FailedPrecondition,
+	ErrorWhileMarshalling:       codes.Internal,
+	InvocationError:             codes.Internal,
+	OutputSchemaViolation:       codes.Internal,
+	RateLimitExceeded:           codes.ResourceExhausted,
+	ConcurrencyLimitExceeded:    codes.ResourceExhausted,
+	MessageTooLarge:             codes.ResourceExhausted,
+}
+
+// badRequestFields names the part of the incoming message at fault, for errors reported as InvalidArgument
+var badRequestFields = map[errorCode]string{
+	ContentTypeNotSupported:     ContentType,
+	InputNotSupported:           Input,
+	ContentEncodingNotSupported: ContentEncoding,
+	ErrorWhileUnmarshalling:     "payload",
+	InputSchemaViolation:        "payload",
+}
+
+// ErrorDomain is the domain of the ErrorInfo details of the statuses reporting invoker errors
+const ErrorDomain = "projectriff.io"
+
+// Keys of the metadata of the ErrorInfo details of the statuses reporting invoker errors
+const (
+	ErrorInfoCause       = "cause"
+	ErrorInfoContentType = "content-type" // the offending content type (or accepted media ranges), if any
+)
+
+// ErrorInfo is the google.rpc.ErrorInfo detail, which the vendored errdetails package predates. Its reason holds the
+// invoker error code.
+type ErrorInfo struct {
+	Reason   string            `protobuf:"bytes,1,opt,name=reason" json:"reason,omitempty"`
+	Domain   string            `protobuf:"bytes,2,opt,name=domain" json:"domain,omitempty"`
+	Metadata map[string]string `protobuf:"bytes,3,rep,name=metadata" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *ErrorInfo) Reset()         { *m = ErrorInfo{} }
+func (m *ErrorInfo) String() string { return proto.CompactTextString(m) }
+func (*ErrorInfo) ProtoMessage()    {}
+
+func init() {
+	proto.RegisterType((*ErrorInfo)(nil), "google.rpc.ErrorInfo")
+}
+
+// status returns the gRPC status corresponding to this error. All statuses carry an ErrorInfo detail, whose reason is
+// the error code and whose metadata hold the cause and the offending content type (if any). InvalidArgument statuses
+// also carry a BadRequest detail, whose field violation names the part of the message at fault. FailedPrecondition
+// statuses also carry a PreconditionFailure detail, whose violation holds the error code, offending content type and
+// cause as its type, subject and description.
+func (ie invokerError) status() *status.Status {
+	code, ok := statusCodes[ie.code]
+	if !ok {
+		code = codes.Unknown
+	}
+	s := status.New(code, ie.Error())
+	info := &ErrorInfo{Reason: string(ie.code), Domain: ErrorDomain, Metadata: map[string]string{ErrorInfoCause: ie.Error()}}
+	if ie.contentType != "" {
+		info.Metadata[ErrorInfoContentType] = string(ie.contentType)
+	}
+	details := []proto.Message{info}
+	switch code {
+	case codes.InvalidArgument:
+		details = append(details, &errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+			Field:       badRequestFields[ie.code],
+			Description: ie.Error(),
+		}}})
+	case codes.FailedPrecondition:
+		details = append(details, &errdetails.PreconditionFailure{Violations: []*errdetails.PreconditionFailure_Violation{{
+			Type:        string(ie.code),
+			Subject:     string(ie.contentType),
+			Description: ie.Error(),
+		}}})
+	}
+	if withDetails, err := s.WithDetails(details...); err == nil {
+		s = withDetails
+	}
+	return s
+}
+
+// statusError turns the given error into a gRPC status error, so that the sidecar can tell client errors from server
+// ones. Errors that don't originate from the invoker or the transport are reported as InvocationErrors.
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if ie, ok := err.(invokerError); ok {
+		return ie.status().Err()
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return invokerError{code: InvocationError, cause: err}.status().Err()
+}